@@ -283,6 +283,652 @@ func runSkillConnectionsMigration() error {
 	return nil
 }
 
+func runPresenceMigration() error {
+	log.Println("Running presence migration...")
+
+	// Persisted presence: the last status we saw and when the user was last online
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS user_presence (
+			user_id INT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+			status VARCHAR(20) DEFAULT 'offline' CHECK (status IN ('online', 'away', 'offline', 'dnd')),
+			manual_status VARCHAR(20) CHECK (manual_status IN ('away', 'dnd')),
+			last_seen TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create user_presence table: %v", err)
+	}
+
+	log.Println("Presence migration completed successfully")
+	return nil
+}
+
+func runReadReceiptsMigration() error {
+	log.Println("Running read receipts migration...")
+
+	_, err := DB.Exec(`ALTER TABLE messages ADD COLUMN IF NOT EXISTS read_at TIMESTAMP`)
+	if err != nil {
+		return fmt.Errorf("failed to add read_at column: %v", err)
+	}
+
+	_, err = DB.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_messages_unread ON messages (receiver_id, sender_id) WHERE read_at IS NULL
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create index: %v", err)
+	}
+
+	log.Println("Read receipts migration completed successfully")
+	return nil
+}
+
+func runConversationStateMigration() error {
+	log.Println("Running conversation state migration...")
+
+	// Per-user view of a 1:1 conversation
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS conversation_state (
+			user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			partner_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			muted BOOLEAN DEFAULT false,
+			archived BOOLEAN DEFAULT false,
+			pinned BOOLEAN DEFAULT false,
+			last_read_message_id INT DEFAULT 0,
+			updated_at TIMESTAMP DEFAULT NOW(),
+			PRIMARY KEY (user_id, partner_id)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create conversation_state table: %v", err)
+	}
+
+	log.Println("Conversation state migration completed successfully")
+	return nil
+}
+
+func runMessageEditsMigration() error {
+	log.Println("Running message edits migration...")
+
+	columns := []string{
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS edited_at TIMESTAMP",
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP",
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS reply_to_id INT REFERENCES messages(id) ON DELETE SET NULL",
+	}
+	for _, col := range columns {
+		if _, err := DB.Exec(col); err != nil {
+			return fmt.Errorf("failed to add messages column: %v", err)
+		}
+	}
+
+	// Previous versions of edited messages
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS message_edits (
+			id SERIAL PRIMARY KEY,
+			message_id INT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+			previous_content TEXT,
+			edited_at TIMESTAMP DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create message_edits table: %v", err)
+	}
+
+	// Messages a participant deleted for themselves only
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS message_hidden (
+			message_id INT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+			user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			hidden_at TIMESTAMP DEFAULT NOW(),
+			PRIMARY KEY (message_id, user_id)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create message_hidden table: %v", err)
+	}
+
+	_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS idx_message_edits_message ON message_edits(message_id)`)
+	if err != nil {
+		return fmt.Errorf("failed to create index: %v", err)
+	}
+
+	log.Println("Message edits migration completed successfully")
+	return nil
+}
+
+func runMessageReactionsMigration() error {
+	log.Println("Running message reactions migration...")
+
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS message_reactions (
+			message_id INT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+			user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			emoji VARCHAR(32) NOT NULL,
+			created_at TIMESTAMP DEFAULT NOW(),
+			PRIMARY KEY (message_id, user_id, emoji)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create message_reactions table: %v", err)
+	}
+
+	log.Println("Message reactions migration completed successfully")
+	return nil
+}
+
+func runChatRoomsMigration() error {
+	log.Println("Running chat rooms migration...")
+
+	// Group rooms; resource rooms have one row per resource swarm
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS resource_chat_rooms (
+			id SERIAL PRIMARY KEY,
+			resource_id INT UNIQUE REFERENCES resources(id) ON DELETE CASCADE,
+			room_name VARCHAR(255) NOT NULL,
+			room_type VARCHAR(20) DEFAULT 'group' CHECK (room_type IN ('group', 'resource')),
+			is_active BOOLEAN DEFAULT true,
+			created_by INT REFERENCES users(id) ON DELETE SET NULL,
+			created_at TIMESTAMP DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create resource_chat_rooms table: %v", err)
+	}
+
+	// Room membership and roles
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS resource_chat_participants (
+			id SERIAL PRIMARY KEY,
+			room_id INT NOT NULL REFERENCES resource_chat_rooms(id) ON DELETE CASCADE,
+			user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			role VARCHAR(20) DEFAULT 'member' CHECK (role IN ('owner', 'admin', 'member')),
+			joined_at TIMESTAMP DEFAULT NOW(),
+			last_read_at TIMESTAMP DEFAULT NOW(),
+			is_active BOOLEAN DEFAULT true,
+			UNIQUE(room_id, user_id)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create resource_chat_participants table: %v", err)
+	}
+
+	// Room messages
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS resource_messages (
+			id SERIAL PRIMARY KEY,
+			room_id INT NOT NULL REFERENCES resource_chat_rooms(id) ON DELETE CASCADE,
+			sender_id INT REFERENCES users(id) ON DELETE CASCADE,
+			content TEXT NOT NULL DEFAULT '',
+			message_type VARCHAR(20) DEFAULT 'text' CHECK (message_type IN ('text', 'system', 'file')),
+			file_id INT,
+			metadata JSONB,
+			created_at TIMESTAMP DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create resource_messages table: %v", err)
+	}
+
+	indexes := []string{
+		"CREATE INDEX IF NOT EXISTS idx_resource_chat_participants_user ON resource_chat_participants(user_id)",
+		"CREATE INDEX IF NOT EXISTS idx_resource_messages_room ON resource_messages(room_id, id)",
+	}
+	for _, idx := range indexes {
+		if _, err := DB.Exec(idx); err != nil {
+			return fmt.Errorf("failed to create index: %v", err)
+		}
+	}
+
+	log.Println("Chat rooms migration completed successfully")
+	return nil
+}
+
+func runMessageSearchMigration() error {
+	log.Println("Running message search migration...")
+
+	// The simple configuration keeps words as typed; chats mix languages and
+	// skill names that stemming would mangle
+	alters := []string{
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS search_vector tsvector
+			GENERATED ALWAYS AS (to_tsvector('simple', COALESCE(content, ''))) STORED`,
+		`ALTER TABLE files ADD COLUMN IF NOT EXISTS search_vector tsvector
+			GENERATED ALWAYS AS (to_tsvector('simple', regexp_replace(COALESCE(filename, ''), '[._-]+', ' ', 'g'))) STORED`,
+	}
+	for _, alter := range alters {
+		if _, err := DB.Exec(alter); err != nil {
+			return fmt.Errorf("failed to add search column: %v", err)
+		}
+	}
+
+	indexes := []string{
+		"CREATE INDEX IF NOT EXISTS idx_messages_search ON messages USING GIN(search_vector)",
+		"CREATE INDEX IF NOT EXISTS idx_files_search ON files USING GIN(search_vector)",
+	}
+	for _, idx := range indexes {
+		if _, err := DB.Exec(idx); err != nil {
+			return fmt.Errorf("failed to create index: %v", err)
+		}
+	}
+
+	log.Println("Message search migration completed successfully")
+	return nil
+}
+
+func runUserBlocksMigration() error {
+	log.Println("Running user blocks migration...")
+
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS user_blocks (
+			blocker_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			blocked_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			created_at TIMESTAMP DEFAULT NOW(),
+			PRIMARY KEY (blocker_id, blocked_id),
+			CHECK (blocker_id != blocked_id)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create user_blocks table: %v", err)
+	}
+
+	if _, err := DB.Exec("CREATE INDEX IF NOT EXISTS idx_user_blocks_blocked ON user_blocks(blocked_id)"); err != nil {
+		return fmt.Errorf("failed to create index: %v", err)
+	}
+
+	log.Println("User blocks migration completed successfully")
+	return nil
+}
+
+func runModerationMigration() error {
+	log.Println("Running moderation migration...")
+
+	alters := []string{
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'moderator', 'admin'))",
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS suspended_until TIMESTAMP",
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS suspension_reason TEXT",
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS removed_at TIMESTAMP",
+		"ALTER TABLE resources ADD COLUMN IF NOT EXISTS removed_at TIMESTAMP",
+	}
+	for _, alter := range alters {
+		if _, err := DB.Exec(alter); err != nil {
+			return fmt.Errorf("failed to alter table: %v", err)
+		}
+	}
+
+	// User reports against messages, profiles and resources
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS content_reports (
+			id SERIAL PRIMARY KEY,
+			reporter_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			target_type VARCHAR(20) NOT NULL CHECK (target_type IN ('message', 'user', 'resource')),
+			target_id INT NOT NULL,
+			target_user_id INT REFERENCES users(id) ON DELETE CASCADE,
+			reason VARCHAR(20) NOT NULL CHECK (reason IN ('spam', 'abuse', 'copyright', 'other')),
+			details TEXT,
+			evidence JSONB,
+			status VARCHAR(20) DEFAULT 'open' CHECK (status IN ('open', 'dismissed', 'actioned')),
+			reviewed_by INT REFERENCES users(id) ON DELETE SET NULL,
+			reviewed_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create content_reports table: %v", err)
+	}
+
+	// Audit log of moderator decisions
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS moderation_actions (
+			id SERIAL PRIMARY KEY,
+			moderator_id INT REFERENCES users(id) ON DELETE SET NULL,
+			report_id INT REFERENCES content_reports(id) ON DELETE SET NULL,
+			action VARCHAR(20) NOT NULL CHECK (action IN ('dismiss', 'remove', 'warn', 'suspend')),
+			target_type VARCHAR(20) NOT NULL,
+			target_id INT NOT NULL,
+			target_user_id INT REFERENCES users(id) ON DELETE CASCADE,
+			note TEXT,
+			expires_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create moderation_actions table: %v", err)
+	}
+
+	indexes := []string{
+		"CREATE INDEX IF NOT EXISTS idx_content_reports_status ON content_reports(status, id)",
+		"CREATE INDEX IF NOT EXISTS idx_content_reports_target ON content_reports(target_type, target_id)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_content_reports_open_once ON content_reports(reporter_id, target_type, target_id) WHERE status = 'open'",
+		"CREATE INDEX IF NOT EXISTS idx_moderation_actions_user ON moderation_actions(target_user_id)",
+	}
+	for _, idx := range indexes {
+		if _, err := DB.Exec(idx); err != nil {
+			return fmt.Errorf("failed to create index: %v", err)
+		}
+	}
+
+	log.Println("Moderation migration completed successfully")
+	return nil
+}
+
+func runContentFilterMigration() error {
+	log.Println("Running content filter migration...")
+
+	// Keyword, link and regex rules managed by moderators at runtime
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS filter_rules (
+			id SERIAL PRIMARY KEY,
+			rule_type VARCHAR(20) NOT NULL CHECK (rule_type IN ('keyword', 'link', 'regex')),
+			pattern TEXT NOT NULL,
+			verdict VARCHAR(20) NOT NULL CHECK (verdict IN ('flag', 'reject')),
+			enabled BOOLEAN DEFAULT true,
+			created_by INT REFERENCES users(id) ON DELETE SET NULL,
+			created_at TIMESTAMP DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create filter_rules table: %v", err)
+	}
+
+	// Every flag and reject, for moderators to review
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS filter_decisions (
+			id SERIAL PRIMARY KEY,
+			user_id INT REFERENCES users(id) ON DELETE CASCADE,
+			kind VARCHAR(30) NOT NULL,
+			target_id INT,
+			verdict VARCHAR(20) NOT NULL CHECK (verdict IN ('flag', 'reject')),
+			filter VARCHAR(50) NOT NULL,
+			reason TEXT,
+			excerpt TEXT,
+			created_at TIMESTAMP DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create filter_decisions table: %v", err)
+	}
+
+	indexes := []string{
+		"CREATE INDEX IF NOT EXISTS idx_filter_decisions_user ON filter_decisions(user_id, id)",
+		"CREATE INDEX IF NOT EXISTS idx_filter_decisions_verdict ON filter_decisions(verdict, id)",
+	}
+	for _, idx := range indexes {
+		if _, err := DB.Exec(idx); err != nil {
+			return fmt.Errorf("failed to create index: %v", err)
+		}
+	}
+
+	log.Println("Content filter migration completed successfully")
+	return nil
+}
+
+func runScheduledMessagesMigration() error {
+	log.Println("Running scheduled messages migration...")
+
+	// released is false while a scheduled message waits for send_at
+	alters := []string{
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS send_at TIMESTAMP",
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP",
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS released BOOLEAN NOT NULL DEFAULT true",
+	}
+	for _, alter := range alters {
+		if _, err := DB.Exec(alter); err != nil {
+			return fmt.Errorf("failed to alter messages table: %v", err)
+		}
+	}
+
+	indexes := []string{
+		"CREATE INDEX IF NOT EXISTS idx_messages_scheduled ON messages(send_at) WHERE NOT released",
+		"CREATE INDEX IF NOT EXISTS idx_messages_expiring ON messages(expires_at) WHERE expires_at IS NOT NULL AND deleted_at IS NULL",
+	}
+	for _, idx := range indexes {
+		if _, err := DB.Exec(idx); err != nil {
+			return fmt.Errorf("failed to create index: %v", err)
+		}
+	}
+
+	log.Println("Scheduled messages migration completed successfully")
+	return nil
+}
+
+func runE2EEMigration() error {
+	log.Println("Running end-to-end encryption migration...")
+
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS user_identity_keys (
+			user_id INT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+			identity_key TEXT NOT NULL,
+			signing_key TEXT NOT NULL,
+			signed_prekey_id INT NOT NULL,
+			signed_prekey TEXT NOT NULL,
+			signed_prekey_sig TEXT NOT NULL,
+			updated_at TIMESTAMP DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create user_identity_keys table: %v", err)
+	}
+
+	_, err = DB.Exec(`
+		CREATE TABLE IF NOT EXISTS user_one_time_prekeys (
+			user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			key_id INT NOT NULL,
+			public_key TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT NOW(),
+			PRIMARY KEY (user_id, key_id)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create user_one_time_prekeys table: %v", err)
+	}
+
+	// Encrypted messages keep content NULL and store the sealed payload
+	alters := []string{
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS encrypted BOOLEAN NOT NULL DEFAULT false",
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS ciphertext TEXT",
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS e2ee_header JSONB",
+	}
+	for _, alter := range alters {
+		if _, err := DB.Exec(alter); err != nil {
+			return fmt.Errorf("failed to alter messages table: %v", err)
+		}
+	}
+
+	log.Println("End-to-end encryption migration completed successfully")
+	return nil
+}
+
+func runResourceBlobsMigration() error {
+	log.Println("Running resource blobs migration...")
+
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS resource_blobs (
+			file_hash VARCHAR(64) PRIMARY KEY,
+			storage_key TEXT NOT NULL,
+			size BIGINT NOT NULL,
+			ref_count INT NOT NULL DEFAULT 0,
+			created_at TIMESTAMP DEFAULT NOW(),
+			orphaned_at TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create resource_blobs table: %v", err)
+	}
+
+	// Identical content may now back several resources
+	if _, err := DB.Exec("ALTER TABLE resources DROP CONSTRAINT IF EXISTS resources_file_hash_key"); err != nil {
+		return fmt.Errorf("failed to drop file_hash unique constraint: %v", err)
+	}
+
+	// Files uploaded before content addressing stay at their old keys
+	_, err = DB.Exec(`
+		INSERT INTO resource_blobs(file_hash, storage_key, size, ref_count)
+		SELECT file_hash, 'p2p_resources/' || MIN(file_name), MAX(file_size), COUNT(*)
+		FROM resources
+		WHERE file_hash IS NOT NULL
+		GROUP BY file_hash
+		ON CONFLICT (file_hash) DO NOTHING
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to backfill resource_blobs: %v", err)
+	}
+
+	indexes := []string{
+		"CREATE INDEX IF NOT EXISTS idx_resources_file_hash ON resources(file_hash)",
+		"CREATE INDEX IF NOT EXISTS idx_resource_blobs_orphaned ON resource_blobs(orphaned_at) WHERE ref_count = 0",
+	}
+	for _, idx := range indexes {
+		if _, err := DB.Exec(idx); err != nil {
+			return fmt.Errorf("failed to create index: %v", err)
+		}
+	}
+
+	log.Println("Resource blobs migration completed successfully")
+	return nil
+}
+
+func runUploadSessionsMigration() error {
+	log.Println("Running upload sessions migration...")
+
+	// Chunks live in blob storage under upload_sessions/<id>/
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS upload_sessions (
+			id VARCHAR(32) PRIMARY KEY,
+			user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			kind VARCHAR(20) NOT NULL,
+			file_name TEXT NOT NULL,
+			content_type TEXT,
+			size BIGINT NOT NULL,
+			received BIGINT NOT NULL DEFAULT 0,
+			metadata JSONB,
+			created_at TIMESTAMP DEFAULT NOW(),
+			updated_at TIMESTAMP DEFAULT NOW(),
+			expires_at TIMESTAMP NOT NULL,
+			completed_at TIMESTAMP,
+			CHECK (received <= size)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create upload_sessions table: %v", err)
+	}
+
+	if _, err := DB.Exec("CREATE INDEX IF NOT EXISTS idx_upload_sessions_expires ON upload_sessions(expires_at)"); err != nil {
+		return fmt.Errorf("failed to create index: %v", err)
+	}
+
+	log.Println("Upload sessions migration completed successfully")
+	return nil
+}
+
+func runStorageQuotaMigration() error {
+	log.Println("Running storage quota migration...")
+
+	// Default quota per role; -1 means unlimited
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS role_storage_quotas (
+			role VARCHAR(20) PRIMARY KEY CHECK (role IN ('user', 'moderator', 'admin')),
+			quota_bytes BIGINT NOT NULL CHECK (quota_bytes >= -1),
+			updated_at TIMESTAMP DEFAULT NOW()
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create role_storage_quotas table: %v", err)
+	}
+
+	_, err = DB.Exec(`
+		INSERT INTO role_storage_quotas(role, quota_bytes) VALUES
+			('user', 2147483648), ('moderator', 10737418240), ('admin', -1)
+		ON CONFLICT (role) DO NOTHING
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to seed role_storage_quotas: %v", err)
+	}
+
+	alters := []string{
+		// Per-user override set by an admin; NULL falls back to the role quota
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS storage_quota BIGINT CHECK (storage_quota >= -1)",
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS profile_photo_size BIGINT NOT NULL DEFAULT 0",
+	}
+	for _, alter := range alters {
+		if _, err := DB.Exec(alter); err != nil {
+			return fmt.Errorf("failed to alter table: %v", err)
+		}
+	}
+
+	indexes := []string{
+		"CREATE INDEX IF NOT EXISTS idx_files_uploader ON files(uploader_id)",
+		"CREATE INDEX IF NOT EXISTS idx_resources_uploader ON resources(uploader_id)",
+		"CREATE INDEX IF NOT EXISTS idx_upload_sessions_user ON upload_sessions(user_id) WHERE completed_at IS NULL",
+	}
+	for _, idx := range indexes {
+		if _, err := DB.Exec(idx); err != nil {
+			return fmt.Errorf("failed to create index: %v", err)
+		}
+	}
+
+	log.Println("Storage quota migration completed successfully")
+	return nil
+}
+
+func runMalwareScanMigration() error {
+	log.Println("Running malware scan migration...")
+
+	// Existing rows start pending so they are scanned too
+	for _, table := range []string{"files", "resources"} {
+		alters := []string{
+			"ALTER TABLE " + table + " ADD COLUMN IF NOT EXISTS scan_status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (scan_status IN ('pending', 'clean', 'quarantined'))",
+			"ALTER TABLE " + table + " ADD COLUMN IF NOT EXISTS scan_signature TEXT",
+			"ALTER TABLE " + table + " ADD COLUMN IF NOT EXISTS scanned_at TIMESTAMP",
+			"ALTER TABLE " + table + " ADD COLUMN IF NOT EXISTS scan_started_at TIMESTAMP",
+			"CREATE INDEX IF NOT EXISTS idx_" + table + "_scan_pending ON " + table + "(id) WHERE scan_status = 'pending'",
+		}
+		for _, alter := range alters {
+			if _, err := DB.Exec(alter); err != nil {
+				return fmt.Errorf("failed to alter %s: %v", table, err)
+			}
+		}
+	}
+
+	log.Println("Malware scan migration completed successfully")
+	return nil
+}
+
+func runImageVariantsMigration() error {
+	log.Println("Running image variants migration...")
+
+	// Resized copies of a chat image or a profile photo; exactly one owner
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS image_variants (
+			id SERIAL PRIMARY KEY,
+			file_id INT REFERENCES files(id) ON DELETE CASCADE,
+			user_id INT REFERENCES users(id) ON DELETE CASCADE,
+			variant VARCHAR(20) NOT NULL,
+			storage_key TEXT NOT NULL UNIQUE,
+			content_type TEXT NOT NULL,
+			width INT NOT NULL,
+			height INT NOT NULL,
+			size BIGINT NOT NULL,
+			created_at TIMESTAMP DEFAULT NOW(),
+			CHECK ((file_id IS NULL) <> (user_id IS NULL))
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create image_variants table: %v", err)
+	}
+
+	indexes := []string{
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_image_variants_file ON image_variants(file_id, variant) WHERE file_id IS NOT NULL",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_image_variants_user ON image_variants(user_id, variant) WHERE user_id IS NOT NULL",
+	}
+	for _, idx := range indexes {
+		if _, err := DB.Exec(idx); err != nil {
+			return fmt.Errorf("failed to create index: %v", err)
+		}
+	}
+
+	log.Println("Image variants migration completed successfully")
+	return nil
+}
+
 func runMigrations() error {
 	log.Println("Running database migrations...")
 
@@ -355,6 +1001,85 @@ func runMigrations() error {
 		return fmt.Errorf("failed to run skill connections migration: %v", err)
 	}
 
+	// Run presence migration
+	if err := runPresenceMigration(); err != nil {
+		return fmt.Errorf("failed to run presence migration: %v", err)
+	}
+
+	// Run read receipts migration
+	if err := runReadReceiptsMigration(); err != nil {
+		return fmt.Errorf("failed to run read receipts migration: %v", err)
+	}
+
+	// Run conversation state migration
+	if err := runConversationStateMigration(); err != nil {
+		return fmt.Errorf("failed to run conversation state migration: %v", err)
+	}
+
+	// Run message edits migration
+	if err := runMessageEditsMigration(); err != nil {
+		return fmt.Errorf("failed to run message edits migration: %v", err)
+	}
+
+	// Run message reactions migration
+	if err := runMessageReactionsMigration(); err != nil {
+		return fmt.Errorf("failed to run message reactions migration: %v", err)
+	}
+
+	// Run chat rooms migration
+	if err := runChatRoomsMigration(); err != nil {
+		return fmt.Errorf("failed to run chat rooms migration: %v", err)
+	}
+
+	// Run message search migration
+	if err := runMessageSearchMigration(); err != nil {
+		return fmt.Errorf("failed to run message search migration: %v", err)
+	}
+
+	// Run user blocks migration
+	if err := runUserBlocksMigration(); err != nil {
+		return fmt.Errorf("failed to run user blocks migration: %v", err)
+	}
+
+	// Run moderation migration
+	if err := runModerationMigration(); err != nil {
+		return fmt.Errorf("failed to run moderation migration: %v", err)
+	}
+
+	// Run content filter migration
+	if err := runContentFilterMigration(); err != nil {
+		return fmt.Errorf("failed to run content filter migration: %v", err)
+	}
+
+	// Run scheduled messages migration
+	if err := runScheduledMessagesMigration(); err != nil {
+		return fmt.Errorf("failed to run scheduled messages migration: %v", err)
+	}
+
+	if err := runE2EEMigration(); err != nil {
+		return fmt.Errorf("failed to run e2ee migration: %v", err)
+	}
+
+	if err := runResourceBlobsMigration(); err != nil {
+		return fmt.Errorf("failed to run resource blobs migration: %v", err)
+	}
+
+	if err := runUploadSessionsMigration(); err != nil {
+		return fmt.Errorf("failed to run upload sessions migration: %v", err)
+	}
+
+	if err := runStorageQuotaMigration(); err != nil {
+		return fmt.Errorf("failed to run storage quota migration: %v", err)
+	}
+
+	if err := runMalwareScanMigration(); err != nil {
+		return fmt.Errorf("failed to run malware scan migration: %v", err)
+	}
+
+	if err := runImageVariantsMigration(); err != nil {
+		return fmt.Errorf("failed to run image variants migration: %v", err)
+	}
+
 	log.Println("Database migrations completed")
 	return nil
 }
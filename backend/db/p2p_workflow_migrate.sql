@@ -60,13 +60,14 @@ CREATE TABLE IF NOT EXISTS learning_progress (
     UNIQUE(user_id, skill_name, resource_id)
 );
 
--- Resource Chat Rooms table
+-- Resource Chat Rooms table (ad-hoc groups and one room per resource swarm)
 CREATE TABLE IF NOT EXISTS resource_chat_rooms (
     id SERIAL PRIMARY KEY,
-    resource_id INT REFERENCES resources(id) ON DELETE CASCADE PRIMARY KEY,
+    resource_id INT UNIQUE REFERENCES resources(id) ON DELETE CASCADE, -- NULL for group rooms
     room_name VARCHAR(255) NOT NULL,
+    room_type VARCHAR(20) DEFAULT 'group', -- group, resource
     is_active BOOLEAN DEFAULT true,
-    created_by INT REFERENCES users(id),
+    created_by INT REFERENCES users(id) ON DELETE SET NULL,
     created_at TIMESTAMP DEFAULT NOW()
 );
 
@@ -75,6 +76,7 @@ CREATE TABLE IF NOT EXISTS resource_chat_participants (
     id SERIAL PRIMARY KEY,
     room_id INT REFERENCES resource_chat_rooms(id) ON DELETE CASCADE,
     user_id INT REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(20) DEFAULT 'member', -- owner, admin, member
     joined_at TIMESTAMP DEFAULT NOW(),
     last_read_at TIMESTAMP DEFAULT NOW(),
     is_active BOOLEAN DEFAULT true,
@@ -86,8 +88,9 @@ CREATE TABLE IF NOT EXISTS resource_messages (
     id SERIAL PRIMARY KEY,
     room_id INT REFERENCES resource_chat_rooms(id) ON DELETE CASCADE,
     sender_id INT REFERENCES users(id) ON DELETE CASCADE,
-    content TEXT NOT NULL,
-    message_type VARCHAR(20) DEFAULT 'text', -- text, system, file, progress
+    content TEXT NOT NULL DEFAULT '',
+    message_type VARCHAR(20) DEFAULT 'text', -- text, system, file
+    file_id INT,
     metadata JSONB, -- For progress updates, file info, etc.
     created_at TIMESTAMP DEFAULT NOW()
 );
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"main/db"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// BlockedUser is one entry of a user's block list
+type BlockedUser struct {
+	UserID       int    `json:"user_id"`
+	Username     string `json:"username"`
+	Name         string `json:"name"`
+	ProfilePhoto string `json:"profile_photo"`
+	BlockedAt    string `json:"blocked_at"`
+}
+
+// isBlocked reports whether either user has blocked the other. Blocks are
+// symmetric in effect: neither side can message, request or see the other.
+func isBlocked(userA, userB int) bool {
+	var blocked bool
+	err := db.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM user_blocks
+			WHERE (blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1)
+		)
+	`, userA, userB).Scan(&blocked)
+	if err != nil {
+		log.Printf("Error checking block between %d and %d: %v", userA, userB, err)
+		return false
+	}
+	return blocked
+}
+
+// isBlockedWithAny reports whether userID and any of others have blocked one
+// another, so a blocked user cannot share a room with the blocker
+func isBlockedWithAny(userID int, others []int) bool {
+	var blocked bool
+	err := db.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM user_blocks
+			WHERE (blocker_id = $1 AND blocked_id = ANY($2)) OR (blocked_id = $1 AND blocker_id = ANY($2))
+		)
+	`, userID, pq.Array(others)).Scan(&blocked)
+	if err != nil {
+		log.Printf("Error checking blocks of %d: %v", userID, err)
+		return false
+	}
+	return blocked
+}
+
+// isMuted reports whether userID muted the conversation with partnerID.
+// Muted messages are still delivered, flagged silent so clients skip the
+// notification.
+func isMuted(userID, partnerID int) bool {
+	var muted bool
+	db.DB.QueryRow(`SELECT muted FROM conversation_state WHERE user_id = $1 AND partner_id = $2`,
+		userID, partnerID).Scan(&muted)
+	return muted
+}
+
+// POST /api/users/block  {user_id, target_id, action: "block"|"unblock"}
+// Muting goes through /api/chats/state with {"muted": true}.
+func BlockUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		UserID   int    `json:"user_id"`
+		TargetID int    `json:"target_id"`
+		Action   string `json:"action"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == 0 || req.TargetID == 0 || req.UserID == req.TargetID {
+		http.Error(w, "user_id and target_id must be two different users", http.StatusBadRequest)
+		return
+	}
+
+	switch req.Action {
+	case "block", "":
+		_, err := db.DB.Exec(`
+			INSERT INTO user_blocks(blocker_id, blocked_id) VALUES($1, $2)
+			ON CONFLICT (blocker_id, blocked_id) DO NOTHING
+		`, req.UserID, req.TargetID)
+		if err != nil {
+			http.Error(w, "Failed to block user: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Outstanding connection requests between the two are void
+		_, err = db.DB.Exec(`
+			UPDATE p2p_connections SET status = 'cancelled', updated_at = NOW()
+			WHERE status = 'pending'
+			AND ((requester_id = $1 AND target_user_id = $2) OR (requester_id = $2 AND target_user_id = $1))
+		`, req.UserID, req.TargetID)
+		if err != nil {
+			log.Printf("Error cancelling connection requests between %d and %d: %v", req.UserID, req.TargetID, err)
+		}
+
+		// The blocked user sees the blocker go offline
+		unifiedManager.sendToUser(req.TargetID, UnifiedMessage{
+			Type:      MsgTypePresence,
+			UserID:    req.UserID,
+			Status:    PresenceOffline,
+			Data:      PresenceInfo{UserID: req.UserID, Status: PresenceOffline},
+			Timestamp: time.Now(),
+		})
+
+	case "unblock":
+		_, err := db.DB.Exec(`DELETE FROM user_blocks WHERE blocker_id = $1 AND blocked_id = $2`, req.UserID, req.TargetID)
+		if err != nil {
+			http.Error(w, "Failed to unblock user: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		http.Error(w, "action must be block or unblock", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"blocked": isBlocked(req.UserID, req.TargetID),
+	})
+}
+
+// GET /api/users/blocks?user_id=1
+func GetBlockedUsers(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil || userID <= 0 {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT u.id, u.username, COALESCE(u.name, ''), COALESCE(u.profile_photo, ''), b.created_at
+		FROM user_blocks b
+		JOIN users u ON u.id = b.blocked_id
+		WHERE b.blocker_id = $1
+		ORDER BY b.created_at DESC
+	`, userID)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	blocked := make([]BlockedUser, 0)
+	for rows.Next() {
+		var b BlockedUser
+		var created time.Time
+		if err := rows.Scan(&b.UserID, &b.Username, &b.Name, &b.ProfilePhoto, &created); err != nil {
+			continue
+		}
+		b.BlockedAt = created.UTC().Format(time.RFC3339)
+		blocked = append(blocked, b)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blocked)
+}
@@ -4,22 +4,33 @@ import (
 	"database/sql"
 	"encoding/json"
 	"main/db"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type ChatListItem struct {
-	UserID       int    `json:"user_id"`
-	Username     string `json:"username"`
-	Name         string `json:"name"`
-	ProfilePhoto string `json:"profile_photo"`
-	LastMsg      string `json:"last_msg"`
-	IsFile       bool   `json:"is_file"`
-	CreatedAt    string `json:"created_at"`
+	UserID            int     `json:"user_id"`
+	Username          string  `json:"username"`
+	Name              string  `json:"name"`
+	ProfilePhoto      string  `json:"profile_photo"`
+	LastMsg           string  `json:"last_msg"`
+	IsFile            bool    `json:"is_file"`
+	CreatedAt         string  `json:"created_at"`
+	LastMsgID         int     `json:"last_msg_id"`
+	LastSenderID      int     `json:"last_sender_id"`
+	LastReadAt        *string `json:"last_read_at"`
+	UnreadCount       int     `json:"unread_count"`
+	Muted             bool    `json:"muted"`
+	Archived          bool    `json:"archived"`
+	Pinned            bool    `json:"pinned"`
+	LastReadMessageID int     `json:"last_read_message_id"`
 }
 
-// GET /api/chats?user_id=1
+// GET /api/chats?user_id=1[&archived=true|all]
+// Pinned conversations come first, then the rest by latest activity.
 func GetChatList(w http.ResponseWriter, r *http.Request) {
 	uidStr := r.URL.Query().Get("user_id")
 	if uidStr == "" {
@@ -28,19 +39,40 @@ func GetChatList(w http.ResponseWriter, r *http.Request) {
 	}
 	uid, _ := strconv.Atoi(uidStr)
 
+	archived := r.URL.Query().Get("archived")
+	archivedFilter := "AND NOT COALESCE(cs.archived, false)"
+	if archived == "true" {
+		archivedFilter = "AND COALESCE(cs.archived, false)"
+	} else if archived == "all" {
+		archivedFilter = ""
+	}
+
 	rows, err := db.DB.Query(`
-		SELECT DISTINCT ON (u.id) 
-		       u.id, u.username, u.name, u.profile_photo,
-		       m.content, m.is_file, m.created_at
-		FROM users u
-		INNER JOIN (
-		  SELECT CASE WHEN sender_id=$1 THEN receiver_id ELSE sender_id END AS other_id,
-		         content, is_file, created_at
-		  FROM messages
-		  WHERE sender_id=$1 OR receiver_id=$1
-		  ORDER BY created_at DESC
-		) m ON u.id = m.other_id
-		ORDER BY u.id, m.created_at DESC
+		WITH last AS (
+		  SELECT DISTINCT ON (other_id)
+		         other_id, id, sender_id, content, is_file, created_at, read_at
+		  FROM (
+		    SELECT CASE WHEN sender_id=$1 THEN receiver_id ELSE sender_id END AS other_id,
+		           id, sender_id, CASE WHEN removed_at IS NULL THEN COALESCE(content, '') ELSE '' END AS content,
+		           is_file, created_at, read_at
+		    FROM messages
+		    WHERE (sender_id=$1 OR receiver_id=$1) AND released
+		    AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = messages.id AND h.user_id = $1)
+		  ) m
+		  ORDER BY other_id, created_at DESC, id DESC
+		)
+		SELECT u.id, u.username, COALESCE(u.name, ''), COALESCE(u.profile_photo, ''),
+		       l.content, l.is_file, l.created_at, l.id, l.sender_id, l.read_at,
+		       COALESCE(cs.muted, false), COALESCE(cs.archived, false), COALESCE(cs.pinned, false),
+		       COALESCE(cs.last_read_message_id, 0),
+		       (SELECT COUNT(*) FROM messages um
+		        WHERE um.sender_id = u.id AND um.receiver_id = $1 AND um.read_at IS NULL AND um.released
+		        AND um.id > COALESCE(cs.last_read_message_id, 0)) AS unread_count
+		FROM last l
+		JOIN users u ON u.id = l.other_id
+		LEFT JOIN conversation_state cs ON cs.user_id = $1 AND cs.partner_id = u.id
+		WHERE 1=1 `+archivedFilter+`
+		ORDER BY COALESCE(cs.pinned, false) DESC, l.created_at DESC
 	`, uid)
 	if err != nil {
 		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
@@ -51,14 +83,24 @@ func GetChatList(w http.ResponseWriter, r *http.Request) {
 	var out []ChatListItem
 	for rows.Next() {
 		var it ChatListItem
-		rows.Scan(&it.UserID, &it.Username, &it.Name, &it.ProfilePhoto, &it.LastMsg, &it.IsFile, &it.CreatedAt)
+		var readAt sql.NullTime
+		err := rows.Scan(&it.UserID, &it.Username, &it.Name, &it.ProfilePhoto, &it.LastMsg, &it.IsFile, &it.CreatedAt,
+			&it.LastMsgID, &it.LastSenderID, &readAt,
+			&it.Muted, &it.Archived, &it.Pinned, &it.LastReadMessageID, &it.UnreadCount)
+		if err != nil {
+			continue
+		}
+		if readAt.Valid {
+			v := readAt.Time.UTC().Format(time.RFC3339)
+			it.LastReadAt = &v
+		}
 		out = append(out, it)
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(out)
 }
 
-// GET /api/users/online?ids=1,2,3 - Check online status of users
+// GET /api/users/online?ids=1,2,3[&viewer_id=4] - Check online status of users
 func GetOnlineStatus(w http.ResponseWriter, r *http.Request) {
 	idsStr := r.URL.Query().Get("ids")
 	if idsStr == "" {
@@ -75,26 +117,63 @@ func GetOnlineStatus(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Check online status
-	type OnlineStatus struct {
-		UserID int  `json:"user_id"`
-		Online bool `json:"online"`
-	}
+	// Blocked users always appear offline to the viewer, with no last-seen
+	viewerID, _ := strconv.Atoi(r.URL.Query().Get("viewer_id"))
 
-	var status []OnlineStatus
+	// Look up presence; offline users carry their last-seen time
+	status := make([]PresenceInfo, 0, len(ids))
 	for _, id := range ids {
-		if _, online := getClient(id); online {
-			status = append(status, OnlineStatus{UserID: id, Online: true})
-		} else {
-			status = append(status, OnlineStatus{UserID: id, Online: false})
+		if viewerID > 0 && isBlocked(viewerID, id) {
+			status = append(status, PresenceInfo{UserID: id, Status: PresenceOffline})
+			continue
 		}
+		status = append(status, presence.lookup(id))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(status)
 }
 
-// GET /api/history?user1=1&user2=2
+// HistoryMessage is one message as returned by GetHistory
+type HistoryMessage struct {
+	ID         int           `json:"id"`
+	SenderID   int           `json:"sender_id"`
+	ReceiverID int           `json:"receiver_id"`
+	Content    string        `json:"content"`
+	IsFile     bool          `json:"is_file"`
+	FileID     *int          `json:"file_id"`
+	CreatedAt  string        `json:"created_at"`
+	ReadAt     *string       `json:"read_at"`
+	EditedAt   *string       `json:"edited_at"`
+	Deleted    bool          `json:"deleted"`
+	Removed    bool          `json:"removed"`           // taken down by a moderator
+	SendAt     *string       `json:"send_at,omitempty"` // set while a scheduled message waits
+	ExpiresAt  *string       `json:"expires_at,omitempty"`
+	ReplyToID  *int          `json:"reply_to_id"`
+	ReplyTo    *ReplyPreview `json:"reply_to,omitempty"`
+
+	// End-to-end encrypted messages have no content; clients decrypt these
+	Encrypted  bool        `json:"encrypted,omitempty"`
+	Ciphertext string      `json:"ciphertext,omitempty"`
+	E2EE       *E2EEHeader `json:"e2ee,omitempty"`
+
+	Reactions []ReactionCount `json:"reactions"`
+}
+
+// ReplyPreview is the quoted message shown above a reply
+type ReplyPreview struct {
+	ID        int    `json:"id"`
+	SenderID  int    `json:"sender_id"`
+	Content   string `json:"content"`
+	IsFile    bool   `json:"is_file"`
+	Deleted   bool   `json:"deleted"`
+	Encrypted bool   `json:"encrypted,omitempty"`
+}
+
+// GET /api/history?user1=1&user2=2[&around_id=10&radius=20]
+// user1 is the viewer: messages they deleted for themselves are left out.
+// around_id limits the result to radius messages either side of one message,
+// which is how search results jump to their context.
 func GetHistory(w http.ResponseWriter, r *http.Request) {
 	u1 := r.URL.Query().Get("user1")
 	u2 := r.URL.Query().Get("user2")
@@ -103,38 +182,106 @@ func GetHistory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := db.DB.Query(`SELECT id, sender_id, receiver_id, content, is_file, file_id, created_at
-		FROM messages
-		WHERE (sender_id=$1 AND receiver_id=$2) OR (sender_id=$2 AND receiver_id=$1)
-		ORDER BY created_at ASC`, u1, u2)
+	fromID, toID := 0, math.MaxInt32
+	if aroundID, _ := strconv.Atoi(r.URL.Query().Get("around_id")); aroundID > 0 {
+		radius, _ := strconv.Atoi(r.URL.Query().Get("radius"))
+		if radius <= 0 || radius > maxHistoryRadius {
+			radius = defaultHistoryRadius
+		}
+		var err error
+		fromID, toID, err = historyWindow(u1, u2, aroundID, radius)
+		if err != nil {
+			http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Moderator-removed messages stay in place with their content withheld
+	rows, err := db.DB.Query(`SELECT m.id, m.sender_id, m.receiver_id,
+		       CASE WHEN m.removed_at IS NULL THEN COALESCE(m.content, '') ELSE '' END,
+		       m.is_file, CASE WHEN m.removed_at IS NULL THEN m.file_id END,
+		       m.created_at, m.read_at, m.edited_at, m.deleted_at IS NOT NULL, m.removed_at IS NOT NULL,
+		       CASE WHEN NOT m.released THEN m.send_at END, m.expires_at,
+		       rm.id, rm.sender_id, CASE WHEN rm.removed_at IS NULL THEN COALESCE(rm.content, '') ELSE '' END,
+		       COALESCE(rm.is_file, false), rm.deleted_at IS NOT NULL OR rm.removed_at IS NOT NULL,
+		       COALESCE(rm.encrypted, false), m.encrypted,
+		       CASE WHEN m.removed_at IS NULL THEN COALESCE(m.ciphertext, '') ELSE '' END,
+		       CASE WHEN m.removed_at IS NULL THEN m.e2ee_header END
+		FROM messages m
+		LEFT JOIN messages rm ON rm.id = m.reply_to_id
+		WHERE ((m.sender_id=$1 AND m.receiver_id=$2) OR (m.sender_id=$2 AND m.receiver_id=$1))
+		AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $1)
+		AND (m.released OR m.sender_id = $1)
+		AND m.id BETWEEN $3 AND $4
+		ORDER BY m.created_at ASC`, u1, u2, fromID, toID)
 	if err != nil {
 		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 
-	type H struct {
-		ID         int    `json:"id"`
-		SenderID   int    `json:"sender_id"`
-		ReceiverID int    `json:"receiver_id"`
-		Content    string `json:"content"`
-		IsFile     bool   `json:"is_file"`
-		FileID     *int   `json:"file_id"`
-		CreatedAt  string `json:"created_at"`
-	}
-
-	var out []H
+	var out []HistoryMessage
 	for rows.Next() {
-		var it H
-		var fileID sql.NullInt32
-		rows.Scan(&it.ID, &it.SenderID, &it.ReceiverID, &it.Content, &it.IsFile, &fileID, &it.CreatedAt)
+		var it HistoryMessage
+		var fileID, replyID, replySender sql.NullInt32
+		var readAt, editedAt, sendAt, expiresAt sql.NullTime
+		var reply ReplyPreview
+		var header []byte
+		err := rows.Scan(&it.ID, &it.SenderID, &it.ReceiverID, &it.Content, &it.IsFile, &fileID,
+			&it.CreatedAt, &readAt, &editedAt, &it.Deleted, &it.Removed, &sendAt, &expiresAt,
+			&replyID, &replySender, &reply.Content, &reply.IsFile, &reply.Deleted,
+			&reply.Encrypted, &it.Encrypted, &it.Ciphertext, &header)
+		if err != nil {
+			continue
+		}
+		it.E2EE = decodeE2EEHeader(header)
 		if fileID.Valid {
 			v := int(fileID.Int32)
 			it.FileID = &v
 		}
+		if readAt.Valid {
+			v := readAt.Time.UTC().Format(time.RFC3339)
+			it.ReadAt = &v
+		}
+		if editedAt.Valid {
+			v := editedAt.Time.UTC().Format(time.RFC3339)
+			it.EditedAt = &v
+		}
+		if sendAt.Valid {
+			v := sendAt.Time.UTC().Format(time.RFC3339)
+			it.SendAt = &v
+		}
+		if expiresAt.Valid {
+			v := expiresAt.Time.UTC().Format(time.RFC3339)
+			it.ExpiresAt = &v
+		}
+		if replyID.Valid {
+			reply.ID = int(replyID.Int32)
+			reply.SenderID = int(replySender.Int32)
+			it.ReplyToID = &reply.ID
+			it.ReplyTo = &reply
+		}
 		out = append(out, it)
 	}
 
+	// Attach aggregated reactions as seen by the viewer
+	messageIDs := make([]int, len(out))
+	for i := range out {
+		messageIDs[i] = out[i].ID
+	}
+	viewerID, _ := strconv.Atoi(u1)
+	reactions, err := loadReactions(messageIDs, viewerID)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range out {
+		out[i].Reactions = reactions[out[i].ID]
+		if out[i].Reactions == nil {
+			out[i].Reactions = []ReactionCount{}
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(out)
 }
@@ -0,0 +1,425 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"main/db"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Filter verdicts. Flagged content is delivered but logged for moderators;
+// rejected content is never persisted.
+const (
+	VerdictAllow  = "allow"
+	VerdictFlag   = "flag"
+	VerdictReject = "reject"
+)
+
+// Kinds of content the filters see
+const (
+	FilterKindChat              = "chat"
+	FilterKindEdit              = "edit"
+	FilterKindRoom              = "room"
+	FilterKindConnectionRequest = "connection_request"
+)
+
+const (
+	filterPruneInterval = time.Minute
+	filterExcerptLength = 500
+
+	duplicateWindow    = 10 * time.Minute
+	duplicateMinLength = 8 // "ok", "thanks!" and the like are not spam
+	duplicateFlagAt    = 3
+	duplicateRejectAt  = 5
+
+	newAccountAge               = 24 * time.Hour
+	newAccountMaxChatRecipients = 10 // distinct people per hour
+	newAccountMaxRequests       = 3  // connection requests per hour
+)
+
+// rateLimits caps how many items of each kind one sender may submit per window
+var rateLimits = map[string]struct {
+	max    int
+	window time.Duration
+}{
+	FilterKindChat:              {30, time.Minute},
+	FilterKindEdit:              {20, time.Minute},
+	FilterKindRoom:              {30, time.Minute},
+	FilterKindConnectionRequest: {10, time.Hour},
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"']+`)
+
+// FilterInput is one piece of user content about to be stored
+type FilterInput struct {
+	Kind     string
+	SenderID int
+	TargetID int // receiver, room or connection target
+	Content  string
+}
+
+// FilterDecision is the outcome of running the filter pipeline
+type FilterDecision struct {
+	Verdict string `json:"verdict"`
+	Filter  string `json:"filter,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// ContentFilter inspects content before it is persisted. Filters return
+// VerdictAllow when they have nothing to say.
+type ContentFilter interface {
+	Name() string
+	Check(in FilterInput) FilterDecision
+}
+
+// contentFilters run in order; the first reject wins, otherwise the first
+// flag is kept
+var contentFilters = []ContentFilter{
+	newRateLimitFilter(),
+	newDuplicateFilter(),
+	&ruleFilter{},
+	newNewAccountFilter(),
+}
+
+// filterRejection is returned by actions whose content the pipeline rejected
+type filterRejection struct {
+	decision FilterDecision
+}
+
+func (e *filterRejection) Error() string {
+	return "message rejected: " + e.decision.Reason
+}
+
+var allow = FilterDecision{Verdict: VerdictAllow}
+
+// rejectionStatus maps a rejection to an HTTP status; rate limits are 429
+func rejectionStatus(d FilterDecision) int {
+	if d.Filter == "rate_limit" {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusUnprocessableEntity
+}
+
+// StartContentFilters loads the moderator rules and starts housekeeping for
+// the in-memory filters
+func StartContentFilters() {
+	if err := filterRules.reload(); err != nil {
+		log.Printf("Error loading filter rules: %v", err)
+	}
+	go func() {
+		ticker := time.NewTicker(filterPruneInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			for _, f := range contentFilters {
+				if p, ok := f.(interface{ prune() }); ok {
+					p.prune()
+				}
+			}
+			// Pick up rules changed by other instances
+			if err := filterRules.reload(); err != nil {
+				log.Printf("Error reloading filter rules: %v", err)
+			}
+		}
+	}()
+}
+
+// filterContent runs the pipeline and logs anything that is not allowed
+func filterContent(in FilterInput) FilterDecision {
+	result := allow
+	for _, f := range contentFilters {
+		d := f.Check(in)
+		if d.Verdict == VerdictAllow {
+			continue
+		}
+		if d.Filter == "" {
+			d.Filter = f.Name()
+		}
+		if d.Verdict == VerdictReject {
+			result = d
+			break
+		}
+		if result.Verdict == VerdictAllow {
+			result = d
+		}
+	}
+
+	if result.Verdict != VerdictAllow {
+		logFilterDecision(in, result)
+	}
+	return result
+}
+
+func logFilterDecision(in FilterInput, d FilterDecision) {
+	excerpt := in.Content
+	if len(excerpt) > filterExcerptLength {
+		excerpt = excerpt[:filterExcerptLength]
+		for !utf8.ValidString(excerpt) {
+			excerpt = excerpt[:len(excerpt)-1]
+		}
+	}
+	_, err := db.DB.Exec(`
+		INSERT INTO filter_decisions(user_id, kind, target_id, verdict, filter, reason, excerpt)
+		VALUES($1, $2, NULLIF($3, 0), $4, $5, $6, $7)
+	`, in.SenderID, in.Kind, in.TargetID, d.Verdict, d.Filter, d.Reason, excerpt)
+	if err != nil {
+		log.Printf("Error logging filter decision for user %d: %v", in.SenderID, err)
+	}
+}
+
+// normalizeContent lowercases and collapses whitespace so trivially varied
+// copies compare equal
+func normalizeContent(content string) string {
+	return strings.Join(strings.Fields(strings.ToLower(content)), " ")
+}
+
+// extractLinkHosts returns the lowercased host of every link in content
+func extractLinkHosts(content string) []string {
+	var hosts []string
+	for _, link := range linkPattern.FindAllString(content, -1) {
+		if !strings.Contains(strings.ToLower(link), "://") {
+			link = "http://" + link
+		}
+		u, err := url.Parse(link)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		hosts = append(hosts, strings.ToLower(u.Hostname()))
+	}
+	return hosts
+}
+
+// rateLimitFilter rejects senders that exceed the per-kind limits
+type rateLimitFilter struct {
+	mu     sync.Mutex
+	events map[string][]time.Time // kind:sender -> recent submissions
+}
+
+func newRateLimitFilter() *rateLimitFilter {
+	return &rateLimitFilter{events: make(map[string][]time.Time)}
+}
+
+func (f *rateLimitFilter) Name() string { return "rate_limit" }
+
+func (f *rateLimitFilter) Check(in FilterInput) FilterDecision {
+	limit, ok := rateLimits[in.Kind]
+	if !ok {
+		return allow
+	}
+
+	now := time.Now()
+	key := fmt.Sprintf("%s:%d", in.Kind, in.SenderID)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	recent := trimBefore(f.events[key], now.Add(-limit.window))
+	if len(recent) >= limit.max {
+		f.events[key] = recent
+		return FilterDecision{
+			Verdict: VerdictReject,
+			Reason:  fmt.Sprintf("slow down: at most %d per %s", limit.max, limit.window),
+		}
+	}
+	f.events[key] = append(recent, now)
+	return allow
+}
+
+func (f *rateLimitFilter) prune() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, times := range f.events {
+		kind := key[:strings.IndexByte(key, ':')]
+		recent := trimBefore(times, time.Now().Add(-rateLimits[kind].window))
+		if len(recent) == 0 {
+			delete(f.events, key)
+		} else {
+			f.events[key] = recent
+		}
+	}
+}
+
+// trimBefore drops timestamps older than cutoff from a sorted slice
+func trimBefore(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+// duplicateFilter catches the same text being sent over and over, usually
+// to many different people
+type duplicateFilter struct {
+	mu     sync.Mutex
+	recent map[int][]duplicateEntry
+}
+
+type duplicateEntry struct {
+	digest string
+	at     time.Time
+}
+
+func newDuplicateFilter() *duplicateFilter {
+	return &duplicateFilter{recent: make(map[int][]duplicateEntry)}
+}
+
+func (f *duplicateFilter) Name() string { return "duplicate" }
+
+func (f *duplicateFilter) Check(in FilterInput) FilterDecision {
+	normalized := normalizeContent(in.Content)
+	if utf8.RuneCountInString(normalized) < duplicateMinLength {
+		return allow
+	}
+	sum := sha256.Sum256([]byte(normalized))
+	digest := hex.EncodeToString(sum[:])
+	now := time.Now()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entries := f.recentEntries(in.SenderID, now)
+	copies := 1
+	for _, e := range entries {
+		if e.digest == digest {
+			copies++
+		}
+	}
+	f.recent[in.SenderID] = append(entries, duplicateEntry{digest: digest, at: now})
+
+	switch {
+	case copies >= duplicateRejectAt:
+		return FilterDecision{Verdict: VerdictReject, Reason: "the same message was sent too many times"}
+	case copies >= duplicateFlagAt:
+		return FilterDecision{Verdict: VerdictFlag, Reason: fmt.Sprintf("identical message sent %d times", copies)}
+	}
+	return allow
+}
+
+func (f *duplicateFilter) recentEntries(senderID int, now time.Time) []duplicateEntry {
+	entries := f.recent[senderID]
+	cutoff := now.Add(-duplicateWindow)
+	i := 0
+	for i < len(entries) && entries[i].at.Before(cutoff) {
+		i++
+	}
+	return entries[i:]
+}
+
+func (f *duplicateFilter) prune() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	for senderID := range f.recent {
+		if entries := f.recentEntries(senderID, now); len(entries) == 0 {
+			delete(f.recent, senderID)
+		} else {
+			f.recent[senderID] = entries
+		}
+	}
+}
+
+// ruleFilter applies the keyword, link and regex rules moderators manage
+// through /api/moderation/filter-rules
+type ruleFilter struct{}
+
+func (f *ruleFilter) Name() string { return "rule" }
+
+func (f *ruleFilter) Check(in FilterInput) FilterDecision {
+	lower := strings.ToLower(in.Content)
+	var hosts []string
+	if linkPattern.MatchString(in.Content) {
+		hosts = extractLinkHosts(in.Content)
+	}
+
+	result := allow
+	for _, rule := range filterRules.snapshot() {
+		if !rule.matches(lower, in.Content, hosts) {
+			continue
+		}
+		d := FilterDecision{
+			Verdict: rule.Verdict,
+			Filter:  fmt.Sprintf("rule:%d", rule.ID),
+			Reason:  fmt.Sprintf("matched %s rule %q", rule.RuleType, rule.Pattern),
+		}
+		if d.Verdict == VerdictReject {
+			return d
+		}
+		if result.Verdict == VerdictAllow {
+			result = d
+		}
+	}
+	return result
+}
+
+// newAccountFilter throttles accounts younger than a day, which is where
+// most spam comes from
+type newAccountFilter struct {
+	mu      sync.Mutex
+	created map[int]time.Time
+}
+
+func newNewAccountFilter() *newAccountFilter {
+	return &newAccountFilter{created: make(map[int]time.Time)}
+}
+
+func (f *newAccountFilter) Name() string { return "new_account" }
+
+func (f *newAccountFilter) Check(in FilterInput) FilterDecision {
+	created, ok := f.accountCreated(in.SenderID)
+	if !ok || time.Since(created) >= newAccountAge {
+		return allow
+	}
+
+	switch in.Kind {
+	case FilterKindChat:
+		var recipients int
+		err := db.DB.QueryRow(`
+			SELECT COUNT(DISTINCT receiver_id) FROM messages
+			WHERE sender_id = $1 AND created_at > NOW() - INTERVAL '1 hour' AND receiver_id != $2
+		`, in.SenderID, in.TargetID).Scan(&recipients)
+		if err == nil && recipients >= newAccountMaxChatRecipients {
+			return FilterDecision{Verdict: VerdictReject, Reason: "new accounts can only message a few people per hour"}
+		}
+	case FilterKindConnectionRequest:
+		var requests int
+		err := db.DB.QueryRow(`
+			SELECT COUNT(*) FROM p2p_connections
+			WHERE requester_id = $1 AND created_at > NOW() - INTERVAL '1 hour'
+		`, in.SenderID).Scan(&requests)
+		if err == nil && requests >= newAccountMaxRequests {
+			return FilterDecision{Verdict: VerdictReject, Reason: "new accounts can only send a few connection requests per hour"}
+		}
+	}
+
+	if linkPattern.MatchString(in.Content) {
+		return FilterDecision{Verdict: VerdictFlag, Reason: "link from an account less than a day old"}
+	}
+	return allow
+}
+
+// accountCreated caches signup times; they never change, so old accounts are
+// answered from memory after the first lookup
+func (f *newAccountFilter) accountCreated(userID int) (time.Time, bool) {
+	f.mu.Lock()
+	created, ok := f.created[userID]
+	f.mu.Unlock()
+	if ok {
+		return created, true
+	}
+
+	if err := db.DB.QueryRow(`SELECT created_at FROM users WHERE id = $1`, userID).Scan(&created); err != nil {
+		return time.Time{}, false
+	}
+	f.mu.Lock()
+	f.created[userID] = created
+	f.mu.Unlock()
+	return created, true
+}
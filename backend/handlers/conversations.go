@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"main/db"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ConversationState is one user's view of a 1:1 conversation
+type ConversationState struct {
+	UserID            int    `json:"user_id"`
+	PartnerID         int    `json:"partner_id"`
+	Muted             bool   `json:"muted"`
+	Archived          bool   `json:"archived"`
+	Pinned            bool   `json:"pinned"`
+	LastReadMessageID int    `json:"last_read_message_id"`
+	UnreadCount       int    `json:"unread_count"`
+	UpdatedAt         string `json:"updated_at,omitempty"`
+}
+
+func getConversationState(userID, partnerID int) (ConversationState, error) {
+	state := ConversationState{UserID: userID, PartnerID: partnerID}
+	var updatedAt sql.NullTime
+
+	err := db.DB.QueryRow(`
+		SELECT muted, archived, pinned, last_read_message_id, updated_at
+		FROM conversation_state
+		WHERE user_id = $1 AND partner_id = $2
+	`, userID, partnerID).Scan(&state.Muted, &state.Archived, &state.Pinned, &state.LastReadMessageID, &updatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return state, err
+	}
+	if updatedAt.Valid {
+		state.UpdatedAt = updatedAt.Time.UTC().Format(time.RFC3339)
+	}
+
+	err = db.DB.QueryRow(`
+		SELECT COUNT(*) FROM messages
+		WHERE sender_id = $1 AND receiver_id = $2 AND read_at IS NULL AND released AND id > $3
+	`, partnerID, userID, state.LastReadMessageID).Scan(&state.UnreadCount)
+	return state, err
+}
+
+// advanceLastRead moves the read high-water mark forward, never backwards
+func advanceLastRead(userID, partnerID, messageID int) {
+	_, err := db.DB.Exec(`
+		INSERT INTO conversation_state(user_id, partner_id, last_read_message_id, updated_at)
+		VALUES($1, $2, $3, NOW())
+		ON CONFLICT (user_id, partner_id)
+		DO UPDATE SET
+			last_read_message_id = GREATEST(conversation_state.last_read_message_id, EXCLUDED.last_read_message_id),
+			updated_at = NOW()
+	`, userID, partnerID, messageID)
+	if err != nil {
+		log.Printf("Error updating last read message for user %d: %v", userID, err)
+	}
+}
+
+// unarchiveOnActivity brings an archived conversation back into the chat
+// list when a new message arrives, unless the receiver muted it
+func unarchiveOnActivity(senderID, receiverID int) {
+	_, err := db.DB.Exec(`
+		UPDATE conversation_state
+		SET archived = false, updated_at = NOW()
+		WHERE user_id = $1 AND partner_id = $2 AND archived AND NOT muted
+	`, receiverID, senderID)
+	if err != nil {
+		log.Printf("Error unarchiving conversation for user %d: %v", receiverID, err)
+	}
+}
+
+// GET /api/chats/state?user_id=1&partner_id=2
+func GetConversationState(w http.ResponseWriter, r *http.Request) {
+	userID, err1 := strconv.Atoi(r.URL.Query().Get("user_id"))
+	partnerID, err2 := strconv.Atoi(r.URL.Query().Get("partner_id"))
+	if err1 != nil || err2 != nil || userID <= 0 || partnerID <= 0 {
+		http.Error(w, "user_id and partner_id required", http.StatusBadRequest)
+		return
+	}
+
+	state, err := getConversationState(userID, partnerID)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
+
+// POST /api/chats/state  {user_id, partner_id, muted?, archived?, pinned?, last_read_message_id?}
+func UpdateConversationState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		UserID            int   `json:"user_id"`
+		PartnerID         int   `json:"partner_id"`
+		Muted             *bool `json:"muted"`
+		Archived          *bool `json:"archived"`
+		Pinned            *bool `json:"pinned"`
+		LastReadMessageID *int  `json:"last_read_message_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == 0 || req.PartnerID == 0 || req.UserID == req.PartnerID {
+		http.Error(w, "user_id and partner_id are required", http.StatusBadRequest)
+		return
+	}
+
+	// NULL leaves a flag unchanged
+	_, err := db.DB.Exec(`
+		INSERT INTO conversation_state(user_id, partner_id, muted, archived, pinned, updated_at)
+		VALUES($1, $2, COALESCE($3, false), COALESCE($4, false), COALESCE($5, false), NOW())
+		ON CONFLICT (user_id, partner_id)
+		DO UPDATE SET
+			muted = COALESCE($3, conversation_state.muted),
+			archived = COALESCE($4, conversation_state.archived),
+			pinned = COALESCE($5, conversation_state.pinned),
+			updated_at = NOW()
+	`, req.UserID, req.PartnerID, req.Muted, req.Archived, req.Pinned)
+	if err != nil {
+		http.Error(w, "Failed to update conversation: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if req.LastReadMessageID != nil {
+		if _, err := markConversationRead(req.UserID, req.PartnerID, *req.LastReadMessageID); err != nil {
+			http.Error(w, "Failed to mark conversation read: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	state, err := getConversationState(req.UserID, req.PartnerID)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
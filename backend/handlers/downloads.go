@@ -0,0 +1,311 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"main/db"
+	"main/storage"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of downloadable objects
+const (
+	DownloadKindFile     = "file"     // chat attachment from the files table
+	DownloadKindResource = "resource" // P2P resource, gated by hasApprovedConnection
+)
+
+const (
+	// Links handed to the frontend for embedding
+	downloadLinkTTL = 15 * time.Minute
+	// Links written into exported transcripts, which are read later
+	exportLinkTTL = 7 * 24 * time.Hour
+)
+
+// downloadSecret signs download links. Set DOWNLOAD_URL_SECRET so links
+// survive restarts and work across instances; otherwise a random key is used.
+// It is loaded on first use so a value from .env is picked up.
+var (
+	downloadSecret     []byte
+	downloadSecretOnce sync.Once
+)
+
+func loadDownloadSecret() {
+	if secret := os.Getenv("DOWNLOAD_URL_SECRET"); secret != "" {
+		downloadSecret = []byte(secret)
+		return
+	}
+	downloadSecret = make([]byte, 32)
+	if _, err := rand.Read(downloadSecret); err != nil {
+		log.Fatalf("cannot generate download signing key: %v", err)
+	}
+	log.Println("DOWNLOAD_URL_SECRET not set; download links will not survive a restart")
+}
+
+func signDownload(kind string, id, userID int, expires int64) string {
+	downloadSecretOnce.Do(loadDownloadSecret)
+	mac := hmac.New(sha256.New, downloadSecret)
+	fmt.Fprintf(mac, "%s:%d:%d:%d", kind, id, userID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedDownloadURL returns a path that lets userID fetch the object until
+// ttl elapses. Access is checked again when the link is used.
+func signedDownloadURL(kind string, id, userID int, ttl time.Duration) string {
+	expires := time.Now().Add(ttl).Unix()
+	q := url.Values{}
+	q.Set("id", strconv.Itoa(id))
+	q.Set("user_id", strconv.Itoa(userID))
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("sig", signDownload(kind, id, userID, expires))
+	return "/api/download/" + kind + "?" + q.Encode()
+}
+
+// verifyDownload checks the link parameters and returns the object and user
+func verifyDownload(r *http.Request, kind string) (id, userID int, ok bool) {
+	q := r.URL.Query()
+	id, err1 := strconv.Atoi(q.Get("id"))
+	userID, err2 := strconv.Atoi(q.Get("user_id"))
+	expires, err3 := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || time.Now().Unix() > expires {
+		return 0, 0, false
+	}
+	expected := signDownload(kind, id, userID, expires)
+	if !hmac.Equal([]byte(expected), []byte(q.Get("sig"))) {
+		return 0, 0, false
+	}
+	return id, userID, true
+}
+
+// canAccessFile reports whether userID may download a chat attachment: the
+// uploader, either side of a direct message the uploader sent with it,
+// members of a room the uploader posted it to, and moderators reviewing
+// reports. Messages from anyone else carrying the file grant nothing.
+func canAccessFile(userID, fileID int) (bool, error) {
+	var ok bool
+	err := db.DB.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM files WHERE id = $1 AND uploader_id = $2)
+		    OR EXISTS (
+		        SELECT 1 FROM messages m
+		        JOIN files f ON f.id = m.file_id AND f.uploader_id = m.sender_id
+		        WHERE m.file_id = $1 AND m.removed_at IS NULL
+		        AND (m.sender_id = $2 OR (m.receiver_id = $2 AND m.released))
+		    )
+		    OR EXISTS (
+		        SELECT 1 FROM resource_messages rm
+		        JOIN files f ON f.id = rm.file_id AND f.uploader_id = rm.sender_id
+		        JOIN resource_chat_participants p ON p.room_id = rm.room_id AND p.user_id = $2 AND p.is_active
+		        WHERE rm.file_id = $1
+		    )
+	`, fileID, userID).Scan(&ok)
+	if err != nil {
+		return false, err
+	}
+	return ok || isModerator(userID), nil
+}
+
+// ownsFile reports whether userID uploaded fileID. Only the uploader may
+// attach a file to a message.
+func ownsFile(userID, fileID int) bool {
+	var ok bool
+	db.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM files WHERE id = $1 AND uploader_id = $2)`, fileID, userID).Scan(&ok)
+	return ok
+}
+
+// canAccessResource applies the same rule as piece downloads
+func canAccessResource(userID, resourceID int) (bool, error) {
+	var removed bool
+	err := db.DB.QueryRow(`SELECT removed_at IS NOT NULL FROM resources WHERE id = $1`, resourceID).Scan(&removed)
+	if err == sql.ErrNoRows || removed {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return hasApprovedConnection(userID, resourceID)
+}
+
+// serveDownload streams a blob as an attachment, with range support
+func serveDownload(w http.ResponseWriter, r *http.Request, key, filename, mimeType string) {
+	blob, info, err := storage.Open(storage.Blobs, key)
+	if err == storage.ErrNotFound {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "storage error: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer blob.Close()
+
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	http.ServeContent(w, r, "", info.LastModified, blob)
+}
+
+// GET /uploads/profiles/<name>
+// Profile photos stay public; they are served from blob storage so every
+// replica can answer.
+func ServeProfilePhoto(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/uploads/profiles/")
+	if name == "" || storage.CleanName(name) != name {
+		http.NotFound(w, r)
+		return
+	}
+	blob, info, err := storage.Open(storage.Blobs, storage.PrefixProfiles+name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer blob.Close()
+
+	if info.ContentType != "" {
+		w.Header().Set("Content-Type", info.ContentType)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, name, info.LastModified, blob)
+}
+
+// GET /api/download/file?id=1&user_id=2&expires=...&sig=...
+func DownloadFile(w http.ResponseWriter, r *http.Request) {
+	fileID, userID, ok := verifyDownload(r, DownloadKindFile)
+	if !ok {
+		http.Error(w, "invalid or expired link", http.StatusForbidden)
+		return
+	}
+	allowed, err := canAccessFile(userID, fileID)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+
+	var filename, stored, mimeType, scanStatus string
+	err = db.DB.QueryRow(`SELECT filename, stored_name, COALESCE(mime_type, ''), scan_status FROM files WHERE id = $1`, fileID).
+		Scan(&filename, &stored, &mimeType, &scanStatus)
+	if err == sql.ErrNoRows {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := scanStatusError(scanStatus); err != nil {
+		writeScanError(w, err)
+		return
+	}
+
+	// ?variant=preview serves a resized copy under the same link and checks
+	if variant := r.URL.Query().Get("variant"); variant != "" {
+		var key string
+		err := db.DB.QueryRow(`SELECT storage_key, content_type FROM image_variants WHERE file_id = $1 AND variant = $2`,
+			fileID, variant).Scan(&key, &mimeType)
+		if err == sql.ErrNoRows {
+			http.Error(w, "no such variant", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		name := strings.TrimSuffix(filename, path.Ext(filename))
+		serveDownload(w, r, key, name+"_"+variant+path.Ext(key), mimeType)
+		return
+	}
+
+	serveDownload(w, r, storage.PrefixUploads+stored, filename, mimeType)
+}
+
+// GET /api/download/resource?id=1&user_id=2&expires=...&sig=...
+func DownloadResource(w http.ResponseWriter, r *http.Request) {
+	resourceID, userID, ok := verifyDownload(r, DownloadKindResource)
+	if !ok {
+		http.Error(w, "invalid or expired link", http.StatusForbidden)
+		return
+	}
+	allowed, err := canAccessResource(userID, resourceID)
+	if err != nil {
+		http.Error(w, "error checking access: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "access denied: approved connection required for this resource", http.StatusForbidden)
+		return
+	}
+
+	var fileName, mimeType, scanStatus string
+	err = db.DB.QueryRow(`SELECT COALESCE(file_name, ''), COALESCE(mime_type, ''), scan_status FROM resources WHERE id = $1`, resourceID).
+		Scan(&fileName, &mimeType, &scanStatus)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err := scanStatusError(scanStatus); err != nil {
+		writeScanError(w, err)
+		return
+	}
+	key, err := resourceStorageKey(resourceID)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	serveDownload(w, r, key, fileName, mimeType)
+}
+
+// GET /api/download/link?kind=file|resource&id=1&user_id=2
+// Issues a short-lived signed link after checking access.
+func GetDownloadLink(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("kind")
+	id, err1 := strconv.Atoi(r.URL.Query().Get("id"))
+	userID, err2 := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err1 != nil || err2 != nil {
+		http.Error(w, "id and user_id required", http.StatusBadRequest)
+		return
+	}
+
+	var allowed bool
+	var err error
+	switch kind {
+	case DownloadKindFile:
+		allowed, err = canAccessFile(userID, id)
+	case DownloadKindResource:
+		allowed, err = canAccessResource(userID, id)
+	default:
+		http.Error(w, "kind must be file or resource", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"url":        signedDownloadURL(kind, id, userID, downloadLinkTTL),
+		"expires_at": time.Now().Add(downloadLinkTTL).UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,373 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"main/db"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// End-to-end encrypted direct messages
+//
+// The server only relays and stores keys and ciphertext; it never sees
+// plaintext or private keys. Clients implement the protocol below.
+//
+// Keys (all public keys are 32 bytes, signatures 64 bytes, base64-encoded):
+//
+//   identity_key          X25519 key used in the key agreement
+//   signing_key           Ed25519 key that signs the signed prekey
+//   signed_prekey         X25519 key, rotated by the client every few weeks
+//   signed_prekey_sig     Ed25519 signature by signing_key over the raw
+//                         signed_prekey bytes; checked by the server on upload
+//   one_time_prekeys      X25519 keys, each handed out at most once
+//
+// Publishing: POST /api/keys with the bundle. Uploading a new signed prekey
+// or more one-time prekeys keeps the identity; changing identity_key or
+// signing_key replaces the identity, discards unused one-time prekeys and
+// sends identity_key_changed to everyone the user talks to.
+//
+// Starting a session (X3DH): the sender fetches GET /api/keys/bundle, which
+// consumes one one-time prekey if any are left, verifies signed_prekey_sig
+// itself and derives the shared secret from
+//
+//   DH1 = DH(IK_a, SPK_b)  DH2 = DH(EK_a, IK_b)  DH3 = DH(EK_a, SPK_b)
+//   DH4 = DH(EK_a, OPK_b)  (only when a one-time prekey was returned)
+//   SK  = HKDF-SHA256(salt = 32 zero bytes, ikm = DH1||DH2||DH3[||DH4],
+//                     info = "skillswap-e2ee-v1")
+//
+// Messages: a chat frame carries ciphertext instead of content plus an
+// e2ee header:
+//
+//   {"type": "chat", "receiver_id": 2, "ciphertext": "<base64>",
+//    "e2ee": {"version": 1, "algorithm": "x3dh-aes256gcm",
+//             "sender_identity_key": "...", "ephemeral_key": "...",
+//             "signed_prekey_id": 7, "one_time_prekey_id": 42,
+//             "nonce": "<base64 12 bytes>"}}
+//
+// ephemeral_key, signed_prekey_id and one_time_prekey_id are only needed on
+// the first message of a session; the receiver uses them to derive SK. Each
+// message is sealed with AES-256-GCM using SK and a fresh random nonce, with
+// the sender and receiver ids ("<sender_id>:<receiver_id>") as associated
+// data. Clients are free to layer a ratchet on top; the server treats the
+// header as opaque beyond the fields it validates.
+//
+// Encrypted messages have no server-side content: they are skipped by
+// search, the spam filter only applies rate limits, they cannot be edited,
+// and GetHistory and exports return the ciphertext and header unchanged.
+
+// MsgTypeIdentityKeyChanged warns a user's contacts that their identity key
+// was replaced, so existing sessions must be re-established and verified
+const MsgTypeIdentityKeyChanged = "identity_key_changed"
+
+const (
+	e2eeKeySize          = 32
+	e2eeNonceSize        = 12
+	maxOneTimePrekeys    = 100 // per upload
+	maxStoredPrekeys     = 500
+	maxCiphertextSize    = 64 << 10
+	e2eeProtocolVersion  = 1
+	e2eeDefaultAlgorithm = "x3dh-aes256gcm"
+)
+
+var errInvalidE2EEHeader = errors.New("invalid e2ee header")
+
+// decodeE2EEHeader parses a stored header; nil for plaintext messages
+func decodeE2EEHeader(raw []byte) *E2EEHeader {
+	if len(raw) == 0 {
+		return nil
+	}
+	var h E2EEHeader
+	if err := json.Unmarshal(raw, &h); err != nil {
+		return nil
+	}
+	return &h
+}
+
+// E2EEHeader is the metadata sent alongside an encrypted message
+type E2EEHeader struct {
+	Version           int    `json:"version"`
+	Algorithm         string `json:"algorithm"`
+	SenderIdentityKey string `json:"sender_identity_key"`
+	EphemeralKey      string `json:"ephemeral_key,omitempty"`
+	SignedPrekeyID    int    `json:"signed_prekey_id,omitempty"`
+	OneTimePrekeyID   int    `json:"one_time_prekey_id,omitempty"`
+	Nonce             string `json:"nonce"`
+}
+
+// PrekeyUpload is one public prekey
+type PrekeyUpload struct {
+	KeyID     int    `json:"key_id"`
+	PublicKey string `json:"public_key"`
+	Signature string `json:"signature,omitempty"` // signed prekey only
+}
+
+// KeyBundle is what a sender needs to start a session with a user
+type KeyBundle struct {
+	UserID        int           `json:"user_id"`
+	IdentityKey   string        `json:"identity_key"`
+	SigningKey    string        `json:"signing_key"`
+	SignedPrekey  PrekeyUpload  `json:"signed_prekey"`
+	OneTimePrekey *PrekeyUpload `json:"one_time_prekey,omitempty"`
+	UpdatedAt     string        `json:"updated_at"`
+}
+
+// decodeKey checks that value is base64 for exactly size bytes
+func decodeKey(value string, size int) ([]byte, bool) {
+	raw, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(raw) != size {
+		return nil, false
+	}
+	return raw, true
+}
+
+// validate checks the parts of the header the server relies on
+func (h *E2EEHeader) validate(ciphertext string) error {
+	if h.Version != e2eeProtocolVersion {
+		return errors.New("unsupported e2ee version")
+	}
+	if h.Algorithm == "" {
+		h.Algorithm = e2eeDefaultAlgorithm
+	}
+	if _, ok := decodeKey(h.SenderIdentityKey, e2eeKeySize); !ok {
+		return errInvalidE2EEHeader
+	}
+	if h.EphemeralKey != "" {
+		if _, ok := decodeKey(h.EphemeralKey, e2eeKeySize); !ok {
+			return errInvalidE2EEHeader
+		}
+	}
+	if _, ok := decodeKey(h.Nonce, e2eeNonceSize); !ok {
+		return errInvalidE2EEHeader
+	}
+	if ciphertext == "" || base64.StdEncoding.DecodedLen(len(ciphertext)) > maxCiphertextSize {
+		return errors.New("ciphertext missing or too large")
+	}
+	if _, err := base64.StdEncoding.DecodeString(ciphertext); err != nil {
+		return errors.New("ciphertext must be base64")
+	}
+	return nil
+}
+
+// POST /api/keys
+// {user_id, identity_key, signing_key, signed_prekey: {key_id, public_key, signature}, one_time_prekeys: [{key_id, public_key}]}
+// signed_prekey and one_time_prekeys are optional after the first upload.
+func PublishKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		UserID         int            `json:"user_id"`
+		IdentityKey    string         `json:"identity_key"`
+		SigningKey     string         `json:"signing_key"`
+		SignedPrekey   *PrekeyUpload  `json:"signed_prekey"`
+		OneTimePrekeys []PrekeyUpload `json:"one_time_prekeys"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == 0 {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return
+	}
+	if _, ok := decodeKey(req.IdentityKey, e2eeKeySize); !ok {
+		http.Error(w, "identity_key must be a base64 32-byte key", http.StatusBadRequest)
+		return
+	}
+	signingKey, ok := decodeKey(req.SigningKey, ed25519.PublicKeySize)
+	if !ok {
+		http.Error(w, "signing_key must be a base64 Ed25519 public key", http.StatusBadRequest)
+		return
+	}
+	if len(req.OneTimePrekeys) > maxOneTimePrekeys {
+		http.Error(w, "too many one-time prekeys in one upload", http.StatusBadRequest)
+		return
+	}
+
+	if req.SignedPrekey != nil {
+		spk, ok := decodeKey(req.SignedPrekey.PublicKey, e2eeKeySize)
+		sig, sigOK := decodeKey(req.SignedPrekey.Signature, ed25519.SignatureSize)
+		if !ok || !sigOK || !ed25519.Verify(ed25519.PublicKey(signingKey), spk, sig) {
+			http.Error(w, "signed_prekey signature does not verify", http.StatusBadRequest)
+			return
+		}
+	}
+	for _, opk := range req.OneTimePrekeys {
+		if _, ok := decodeKey(opk.PublicKey, e2eeKeySize); !ok {
+			http.Error(w, "one_time_prekeys must be base64 32-byte keys", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var oldIdentity, oldSigning string
+	err = tx.QueryRow(`SELECT identity_key, signing_key FROM user_identity_keys WHERE user_id = $1 FOR UPDATE`, req.UserID).
+		Scan(&oldIdentity, &oldSigning)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	isNew := err == sql.ErrNoRows
+	identityChanged := !isNew && (oldIdentity != req.IdentityKey || oldSigning != req.SigningKey)
+
+	// A new identity needs a signed prekey made with the new signing key
+	if (isNew || identityChanged) && req.SignedPrekey == nil {
+		http.Error(w, "signed_prekey required when publishing a new identity", http.StatusBadRequest)
+		return
+	}
+
+	if req.SignedPrekey != nil {
+		_, err = tx.Exec(`
+			INSERT INTO user_identity_keys(user_id, identity_key, signing_key, signed_prekey_id, signed_prekey, signed_prekey_sig, updated_at)
+			VALUES($1, $2, $3, $4, $5, $6, NOW())
+			ON CONFLICT (user_id) DO UPDATE SET
+				identity_key = EXCLUDED.identity_key,
+				signing_key = EXCLUDED.signing_key,
+				signed_prekey_id = EXCLUDED.signed_prekey_id,
+				signed_prekey = EXCLUDED.signed_prekey,
+				signed_prekey_sig = EXCLUDED.signed_prekey_sig,
+				updated_at = NOW()
+		`, req.UserID, req.IdentityKey, req.SigningKey, req.SignedPrekey.KeyID, req.SignedPrekey.PublicKey, req.SignedPrekey.Signature)
+		if err != nil {
+			http.Error(w, "Failed to store keys: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Prekeys made for the old identity are useless now
+	if identityChanged {
+		if _, err := tx.Exec(`DELETE FROM user_one_time_prekeys WHERE user_id = $1`, req.UserID); err != nil {
+			http.Error(w, "Failed to reset prekeys: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	for _, opk := range req.OneTimePrekeys {
+		_, err := tx.Exec(`
+			INSERT INTO user_one_time_prekeys(user_id, key_id, public_key) VALUES($1, $2, $3)
+			ON CONFLICT (user_id, key_id) DO NOTHING
+		`, req.UserID, opk.KeyID, opk.PublicKey)
+		if err != nil {
+			http.Error(w, "Failed to store prekeys: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var remaining int
+	tx.QueryRow(`SELECT COUNT(*) FROM user_one_time_prekeys WHERE user_id = $1`, req.UserID).Scan(&remaining)
+	if remaining > maxStoredPrekeys {
+		http.Error(w, "too many unused one-time prekeys stored", http.StatusBadRequest)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if identityChanged {
+		log.Printf("User %d replaced their identity key", req.UserID)
+		for _, otherID := range presenceAudience(req.UserID) {
+			unifiedManager.sendToUser(otherID, UnifiedMessage{
+				Type:      MsgTypeIdentityKeyChanged,
+				UserID:    req.UserID,
+				Timestamp: time.Now(),
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":                     "success",
+		"identity_changed":           identityChanged,
+		"one_time_prekeys_remaining": remaining,
+	})
+}
+
+// GET /api/keys/bundle?user_id=2&requester_id=1
+// Returns user_id's key bundle and consumes one of their one-time prekeys.
+func GetKeyBundle(w http.ResponseWriter, r *http.Request) {
+	userID, err1 := strconv.Atoi(r.URL.Query().Get("user_id"))
+	requesterID, err2 := strconv.Atoi(r.URL.Query().Get("requester_id"))
+	if err1 != nil || err2 != nil {
+		http.Error(w, "user_id and requester_id required", http.StatusBadRequest)
+		return
+	}
+	if isBlocked(userID, requesterID) {
+		http.Error(w, "you cannot message this user", http.StatusForbidden)
+		return
+	}
+
+	bundle := KeyBundle{UserID: userID}
+	var updated time.Time
+	err := db.DB.QueryRow(`
+		SELECT identity_key, signing_key, signed_prekey_id, signed_prekey, signed_prekey_sig, updated_at
+		FROM user_identity_keys WHERE user_id = $1
+	`, userID).Scan(&bundle.IdentityKey, &bundle.SigningKey, &bundle.SignedPrekey.KeyID,
+		&bundle.SignedPrekey.PublicKey, &bundle.SignedPrekey.Signature, &updated)
+	if err == sql.ErrNoRows {
+		http.Error(w, "user has not published keys", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	bundle.UpdatedAt = updated.UTC().Format(time.RFC3339)
+
+	// Claim the oldest one-time prekey; SKIP LOCKED keeps two concurrent
+	// requesters from getting the same key
+	var opk PrekeyUpload
+	err = db.DB.QueryRow(`
+		DELETE FROM user_one_time_prekeys
+		WHERE (user_id, key_id) = (
+			SELECT user_id, key_id FROM user_one_time_prekeys
+			WHERE user_id = $1
+			ORDER BY created_at, key_id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING key_id, public_key
+	`, userID).Scan(&opk.KeyID, &opk.PublicKey)
+	if err == nil {
+		bundle.OneTimePrekey = &opk
+	} else if err != sql.ErrNoRows {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bundle)
+}
+
+// GET /api/keys/count?user_id=1
+// Clients top up their one-time prekeys when this runs low.
+func GetPrekeyCount(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil || userID <= 0 {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return
+	}
+
+	var count int
+	if err := db.DB.QueryRow(`SELECT COUNT(*) FROM user_one_time_prekeys WHERE user_id = $1`, userID).Scan(&count); err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"one_time_prekeys_remaining": count})
+}
@@ -0,0 +1,354 @@
+package handlers
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"main/db"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export formats
+const (
+	ExportJSON = "json"
+	ExportHTML = "html"
+	ExportText = "txt"
+)
+
+// flush to the client every this many messages
+const exportFlushEvery = 200
+
+// ExportParticipant is one side of an exported conversation
+type ExportParticipant struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+}
+
+// ExportMessage is one message in an export
+type ExportMessage struct {
+	ID         int         `json:"id"`
+	SenderID   int         `json:"sender_id"`
+	Sender     string      `json:"sender"`
+	Content    string      `json:"content"`
+	CreatedAt  string      `json:"created_at"`
+	EditedAt   *string     `json:"edited_at,omitempty"`
+	ReadAt     *string     `json:"read_at,omitempty"`
+	ReplyToID  *int        `json:"reply_to_id,omitempty"`
+	Deleted    bool        `json:"deleted,omitempty"`
+	Removed    bool        `json:"removed,omitempty"`
+	Attachment *Attachment `json:"attachment,omitempty"`
+
+	// Encrypted messages are exported sealed; only the participants' clients can open them
+	Encrypted  bool        `json:"encrypted,omitempty"`
+	Ciphertext string      `json:"ciphertext,omitempty"`
+	E2EE       *E2EEHeader `json:"e2ee,omitempty"`
+}
+
+// Attachment is a file message resolved to its name and download link
+type Attachment struct {
+	FileID   int    `json:"file_id"`
+	FileName string `json:"file_name"`
+	Size     int64  `json:"size"`
+	MimeType string `json:"mime_type"`
+	URL      string `json:"url"`
+}
+
+// exportHeader describes the conversation being exported
+type exportHeader struct {
+	ExportedAt   string              `json:"exported_at"`
+	ExportedBy   int                 `json:"exported_by"`
+	Participants []ExportParticipant `json:"participants"`
+}
+
+// transcriptWriter renders an export one message at a time so large
+// histories never sit in memory
+type transcriptWriter interface {
+	begin(h exportHeader) error
+	message(m ExportMessage) error
+	end(count int) error
+}
+
+// text renders a message body for the human-readable formats
+func (m ExportMessage) text() string {
+	switch {
+	case m.Removed:
+		return "[removed by a moderator]"
+	case m.Deleted:
+		return "[message deleted]"
+	case m.Encrypted:
+		return "[encrypted message]"
+	case m.Attachment != nil:
+		return fmt.Sprintf("[file] %s (%s)", m.Attachment.FileName, m.Attachment.URL)
+	}
+	return m.Content
+}
+
+type jsonTranscript struct {
+	w     io.Writer
+	first bool
+}
+
+func (t *jsonTranscript) begin(h exportHeader) error {
+	header, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	// Reopen the header object to append the streamed messages array
+	_, err = fmt.Fprintf(t.w, "%s,\"messages\":[", strings.TrimSuffix(string(header), "}"))
+	t.first = true
+	return err
+}
+
+func (t *jsonTranscript) message(m ExportMessage) error {
+	if !t.first {
+		if _, err := io.WriteString(t.w, ","); err != nil {
+			return err
+		}
+	}
+	t.first = false
+	return json.NewEncoder(t.w).Encode(m)
+}
+
+func (t *jsonTranscript) end(count int) error {
+	_, err := fmt.Fprintf(t.w, "],\"message_count\":%d}\n", count)
+	return err
+}
+
+type textTranscript struct {
+	w io.Writer
+}
+
+func (t *textTranscript) begin(h exportHeader) error {
+	names := make([]string, len(h.Participants))
+	for i, p := range h.Participants {
+		names[i] = p.Username
+	}
+	_, err := fmt.Fprintf(t.w, "Conversation between %s\nExported %s\n\n", strings.Join(names, " and "), h.ExportedAt)
+	return err
+}
+
+func (t *textTranscript) message(m ExportMessage) error {
+	edited := ""
+	if m.EditedAt != nil {
+		edited = " (edited)"
+	}
+	// Indent continuation lines so multi-line messages stay readable
+	body := strings.ReplaceAll(m.text(), "\n", "\n    ")
+	_, err := fmt.Fprintf(t.w, "[%s] %s: %s%s\n", m.CreatedAt, m.Sender, body, edited)
+	return err
+}
+
+func (t *textTranscript) end(count int) error {
+	_, err := fmt.Fprintf(t.w, "\n%d messages\n", count)
+	return err
+}
+
+var htmlTranscriptHead = template.Must(template.New("head").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Conversation between {{range $i, $p := .Participants}}{{if $i}} and {{end}}{{$p.Username}}{{end}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 760px; margin: 2rem auto; color: #222; }
+header { border-bottom: 1px solid #ddd; margin-bottom: 1rem; }
+.msg { margin: .6rem 0; padding: .5rem .75rem; border-radius: 8px; background: #f3f4f6; }
+.msg.mine { background: #e0edff; }
+.meta { font-size: .8rem; color: #666; }
+.body { white-space: pre-wrap; word-wrap: break-word; }
+.gone { font-style: italic; color: #888; }
+</style>
+</head>
+<body>
+<header>
+<h1>Conversation between {{range $i, $p := .Participants}}{{if $i}} and {{end}}{{$p.Username}}{{end}}</h1>
+<p class="meta">Exported {{.ExportedAt}}</p>
+</header>
+<main>
+`))
+
+var htmlTranscriptMessage = template.Must(template.New("message").Parse(`<div class="msg{{if .Mine}} mine{{end}}" id="m{{.ID}}">
+<div class="meta">{{.Sender}} &middot; {{.CreatedAt}}{{if .EditedAt}} &middot; edited{{end}}{{if .ReplyToID}} &middot; <a href="#m{{.ReplyToID}}">in reply</a>{{end}}</div>
+{{if .Removed}}<div class="body gone">removed by a moderator</div>{{else if .Deleted}}<div class="body gone">message deleted</div>{{else if .Encrypted}}<div class="body gone">encrypted message</div>{{else if .Attachment}}<div class="body"><a href="{{.Attachment.URL}}">{{.Attachment.FileName}}</a></div>{{else}}<div class="body">{{.Content}}</div>{{end}}
+</div>
+`))
+
+type htmlTranscript struct {
+	w      io.Writer
+	viewer int
+}
+
+func (t *htmlTranscript) begin(h exportHeader) error {
+	return htmlTranscriptHead.Execute(t.w, h)
+}
+
+func (t *htmlTranscript) message(m ExportMessage) error {
+	return htmlTranscriptMessage.Execute(t.w, struct {
+		ExportMessage
+		Mine bool
+	}{m, m.SenderID == t.viewer})
+}
+
+func (t *htmlTranscript) end(count int) error {
+	_, err := fmt.Fprintf(t.w, "</main>\n<footer class=\"meta\">%d messages</footer>\n</body>\n</html>\n", count)
+	return err
+}
+
+// requestBaseURL is used to turn attachment paths into absolute links that
+// still work once the export is saved elsewhere
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// GET /api/chats/export?user_id=1&partner_id=2[&format=json|html|txt]
+// user_id is the viewer; messages they deleted for themselves and scheduled
+// messages that were not sent yet are left out.
+func ExportConversation(w http.ResponseWriter, r *http.Request) {
+	userID, err1 := strconv.Atoi(r.URL.Query().Get("user_id"))
+	partnerID, err2 := strconv.Atoi(r.URL.Query().Get("partner_id"))
+	if err1 != nil || err2 != nil || userID <= 0 || partnerID <= 0 {
+		http.Error(w, "user_id and partner_id required", http.StatusBadRequest)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = ExportJSON
+	}
+
+	participants := make([]ExportParticipant, 0, 2)
+	names := make(map[int]string)
+	for _, id := range []int{userID, partnerID} {
+		p := ExportParticipant{ID: id}
+		err := db.DB.QueryRow(`SELECT username, COALESCE(name, '') FROM users WHERE id = $1`, id).Scan(&p.Username, &p.Name)
+		if err == sql.ErrNoRows {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		participants = append(participants, p)
+		names[id] = p.Username
+	}
+
+	out := bufio.NewWriterSize(w, 32<<10)
+	var tw transcriptWriter
+	var contentType, ext string
+	switch format {
+	case ExportJSON:
+		tw, contentType, ext = &jsonTranscript{w: out}, "application/json", "json"
+	case ExportHTML:
+		tw, contentType, ext = &htmlTranscript{w: out, viewer: userID}, "text/html; charset=utf-8", "html"
+	case ExportText:
+		tw, contentType, ext = &textTranscript{w: out}, "text/plain; charset=utf-8", "txt"
+	default:
+		http.Error(w, "format must be json, html or txt", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT m.id, m.sender_id, COALESCE(m.content, ''), m.created_at, m.edited_at, m.read_at, m.reply_to_id,
+		       m.deleted_at IS NOT NULL, m.removed_at IS NOT NULL,
+		       f.id, COALESCE(f.filename, ''), COALESCE(f.size, 0), COALESCE(f.mime_type, ''),
+		       m.encrypted, COALESCE(m.ciphertext, ''), m.e2ee_header
+		FROM messages m
+		LEFT JOIN files f ON f.id = m.file_id AND m.removed_at IS NULL
+		WHERE ((m.sender_id = $1 AND m.receiver_id = $2) OR (m.sender_id = $2 AND m.receiver_id = $1))
+		AND m.released
+		AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $1)
+		ORDER BY m.created_at ASC, m.id ASC
+	`, userID, partnerID)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	filename := fmt.Sprintf("conversation-%s-%s-%s.%s", names[userID], names[partnerID], time.Now().UTC().Format("20060102"), ext)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+
+	flusher, _ := w.(http.Flusher)
+	baseURL := requestBaseURL(r)
+
+	if err := tw.begin(exportHeader{
+		ExportedAt:   time.Now().UTC().Format(time.RFC3339),
+		ExportedBy:   userID,
+		Participants: participants,
+	}); err != nil {
+		log.Printf("Export for user %d failed: %v", userID, err)
+		return
+	}
+
+	count := 0
+	for rows.Next() {
+		var m ExportMessage
+		var created time.Time
+		var editedAt, readAt sql.NullTime
+		var replyTo, fileID sql.NullInt32
+		var att Attachment
+		var header []byte
+		err := rows.Scan(&m.ID, &m.SenderID, &m.Content, &created, &editedAt, &readAt, &replyTo,
+			&m.Deleted, &m.Removed, &fileID, &att.FileName, &att.Size, &att.MimeType,
+			&m.Encrypted, &m.Ciphertext, &header)
+		if err != nil {
+			continue
+		}
+		m.Sender = names[m.SenderID]
+		m.CreatedAt = created.UTC().Format(time.RFC3339)
+		if editedAt.Valid {
+			v := editedAt.Time.UTC().Format(time.RFC3339)
+			m.EditedAt = &v
+		}
+		if readAt.Valid {
+			v := readAt.Time.UTC().Format(time.RFC3339)
+			m.ReadAt = &v
+		}
+		if replyTo.Valid {
+			v := int(replyTo.Int32)
+			m.ReplyToID = &v
+		}
+		if m.Removed {
+			m.Content = ""
+			m.Ciphertext = ""
+		} else {
+			m.E2EE = decodeE2EEHeader(header)
+		}
+		if fileID.Valid {
+			att.FileID = int(fileID.Int32)
+			att.URL = baseURL + signedDownloadURL(DownloadKindFile, att.FileID, userID, exportLinkTTL)
+			m.Attachment = &att
+		}
+
+		if err := tw.message(m); err != nil {
+			// The client went away; nothing more to do
+			log.Printf("Export for user %d aborted: %v", userID, err)
+			return
+		}
+		count++
+		if count%exportFlushEvery == 0 {
+			out.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Export for user %d failed mid-stream: %v", userID, err)
+	}
+
+	tw.end(count)
+	out.Flush()
+}
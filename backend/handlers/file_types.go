@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// File type policy
+//
+// Uploads are typed by sniffing their first bytes rather than trusting the
+// client's Content-Type. The sniffed type must be allowed for the kind of
+// upload, and the file name's extension must not claim something else. The
+// policy per kind can be changed from the environment with comma-separated
+// patterns such as "image/*,application/pdf" or "*":
+//
+//	UPLOAD_TYPES_ALLOW_ATTACHMENT    UPLOAD_TYPES_DENY_ATTACHMENT
+//	UPLOAD_TYPES_ALLOW_RESOURCE      UPLOAD_TYPES_DENY_RESOURCE
+//	UPLOAD_TYPES_ALLOW_PROFILE_PHOTO UPLOAD_TYPES_DENY_PROFILE_PHOTO
+//
+// Deny wins over allow.
+
+// UploadKindProfilePhoto is only uploaded directly, never as a resumable upload
+const UploadKindProfilePhoto = "profile_photo"
+
+// sniffLen is how much http.DetectContentType looks at
+const sniffLen = 512
+
+var (
+	errFileTypeNotAllowed = errors.New("file type not allowed")
+	errFileTypeMismatch   = errors.New("file content does not match its extension")
+)
+
+// executableTypes are refused everywhere by default
+var executableTypes = []string{
+	"application/x-executable",
+	"application/x-msdownload",
+	"application/x-msdos-program",
+	"application/vnd.microsoft.portable-executable",
+	"application/x-mach-binary",
+	"application/x-sh",
+	"text/x-shellscript",
+}
+
+type fileTypePolicy struct {
+	allow []string
+	deny  []string
+}
+
+var defaultFileTypePolicies = map[string]fileTypePolicy{
+	UploadKindAttachment:   {allow: []string{"*"}, deny: executableTypes},
+	UploadKindResource:     {allow: []string{"*"}, deny: executableTypes},
+	UploadKindProfilePhoto: {allow: []string{"image/jpeg", "image/png", "image/gif"}},
+}
+
+var (
+	fileTypePolicies     map[string]fileTypePolicy
+	fileTypePoliciesOnce sync.Once
+)
+
+// fileTypePolicyFor reads the policy overrides the first time it is asked,
+// after .env has been loaded
+func fileTypePolicyFor(kind string) fileTypePolicy {
+	fileTypePoliciesOnce.Do(func() {
+		fileTypePolicies = make(map[string]fileTypePolicy, len(defaultFileTypePolicies))
+		for k, p := range defaultFileTypePolicies {
+			env := strings.ToUpper(k)
+			if v, ok := os.LookupEnv("UPLOAD_TYPES_ALLOW_" + env); ok {
+				p.allow = splitPatterns(v)
+			}
+			if v, ok := os.LookupEnv("UPLOAD_TYPES_DENY_" + env); ok {
+				p.deny = splitPatterns(v)
+			}
+			fileTypePolicies[k] = p
+		}
+	})
+	return fileTypePolicies[kind]
+}
+
+func splitPatterns(v string) []string {
+	var out []string
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.ToLower(strings.TrimSpace(p)); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func matchesAny(patterns []string, mimeType string) bool {
+	for _, p := range patterns {
+		if p == "*" || p == mimeType || (strings.HasSuffix(p, "/*") && strings.HasPrefix(mimeType, p[:len(p)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p fileTypePolicy) permits(mimeType string) bool {
+	return matchesAny(p.allow, mimeType) && !matchesAny(p.deny, mimeType)
+}
+
+// baseType drops parameters such as charset
+func baseType(contentType string) string {
+	t, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+// sniffContentType types head by its magic bytes. It adds the executable
+// formats http.DetectContentType reports as plain binary or text.
+func sniffContentType(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("\x7fELF")):
+		return "application/x-executable"
+	case bytes.HasPrefix(head, []byte("MZ")):
+		return "application/x-msdownload"
+	case bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xce}), bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xcf}),
+		bytes.HasPrefix(head, []byte{0xce, 0xfa, 0xed, 0xfe}), bytes.HasPrefix(head, []byte{0xcf, 0xfa, 0xed, 0xfe}):
+		return "application/x-mach-binary"
+	case bytes.HasPrefix(head, []byte("#!")):
+		return "text/x-shellscript"
+	}
+	return baseType(http.DetectContentType(head))
+}
+
+// Types the sniffer always recognizes, so an extension claiming one of them
+// on content sniffed as anything else is lying
+var reliablySniffed = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"image/bmp":       true,
+	"application/pdf": true,
+}
+
+// Sniff results that only say what a file is built on: many formats are
+// plain text, XML, a zip or gzip container, or unrecognized binary
+var genericSniffs = map[string]bool{
+	"application/octet-stream": true,
+	"text/plain":               true,
+	"text/xml":                 true,
+	"application/zip":          true,
+	"application/x-gzip":       true,
+}
+
+func isMedia(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "audio/") || strings.HasPrefix(mimeType, "video/") || mimeType == "application/ogg"
+}
+
+// extensionMatches reports whether the extension's type agrees with the
+// sniffed one
+func extensionMatches(extType, sniffed string) bool {
+	switch {
+	case extType == "" || extType == sniffed:
+		return true
+	case reliablySniffed[extType]:
+		return false
+	case isMedia(extType) && isMedia(sniffed):
+		// Containers such as mp4 and ogg carry both audio and video
+		return true
+	}
+	return genericSniffs[sniffed]
+}
+
+// checkFileType sniffs head and applies the policy for kind. It returns the
+// type to store: the sniffed type, or the extension's when the sniffer could
+// only tell the general format and the extension is more specific.
+func checkFileType(kind, fileName string, head []byte) (string, error) {
+	policy := fileTypePolicyFor(kind)
+	sniffed := sniffContentType(head)
+	ext := strings.ToLower(filepath.Ext(fileName))
+	extType := baseType(mime.TypeByExtension(ext))
+
+	if !policy.permits(sniffed) {
+		return "", fmt.Errorf("%w: %s", errFileTypeNotAllowed, sniffed)
+	}
+	if !extensionMatches(extType, sniffed) {
+		return "", fmt.Errorf("%w: %s content with a %s extension", errFileTypeMismatch, sniffed, ext)
+	}
+
+	effective := sniffed
+	if genericSniffs[sniffed] && extType != "" {
+		effective = extType
+	}
+	if !policy.permits(effective) {
+		return "", fmt.Errorf("%w: %s", errFileTypeNotAllowed, effective)
+	}
+	return effective, nil
+}
+
+// checkDeclaredFileType applies the policy to a file name alone, for
+// rejecting a resumable upload before any bytes arrive. The content is
+// checked again when the upload is finalized.
+func checkDeclaredFileType(kind, fileName string) error {
+	extType := baseType(mime.TypeByExtension(strings.ToLower(filepath.Ext(fileName))))
+	if extType != "" && !fileTypePolicyFor(kind).permits(extType) {
+		return fmt.Errorf("%w: %s", errFileTypeNotAllowed, extType)
+	}
+	return nil
+}
+
+// writeFileTypeError answers a failed checkFileType
+func writeFileTypeError(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+}
+
+// readHead returns up to sniffLen bytes from the start of r
+func readHead(r io.Reader) ([]byte, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return head[:n], err
+}
+
+// headWriter keeps the first sniffLen bytes written through it
+type headWriter struct {
+	head []byte
+}
+
+func (h *headWriter) Write(p []byte) (int, error) {
+	if room := sniffLen - len(h.head); room > 0 {
+		h.head = append(h.head, p[:min(room, len(p))]...)
+	}
+	return len(p), nil
+}
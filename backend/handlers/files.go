@@ -3,86 +3,133 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"log"
 	"main/db"
-	"mime/multipart"
+	"main/storage"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 	"time"
 )
 
-func saveFile(fh *multipart.FileHeader, dstDir string) (storedName string, err error) {
-	in, err := fh.Open()
-	if err != nil {
-		return "", err
-	}
-	defer in.Close()
-
-	fn := filepath.Base(fh.Filename)
-	storedName = fmt.Sprintf("%d_%s", time.Now().UnixNano(), fn)
-	dst := filepath.Join(dstDir, storedName)
-
-	out, err := os.Create(dst)
-	if err != nil {
-		return "", err
-	}
-	defer out.Close()
+const maxAttachmentSize = 100 << 20 // 100MB
 
-	_, err = io.Copy(out, in)
+// saveFile stores a spooled chat attachment under storage.PrefixUploads
+func saveFile(upload *resourceUpload, mimeType string) (storedName string, err error) {
+	storedName = fmt.Sprintf("%d_%s", time.Now().UnixNano(), storage.CleanName(upload.fileName))
+	err = storage.PutFile(storage.Blobs, storage.PrefixUploads+storedName, upload.tmpPath, upload.size, mimeType)
 	return storedName, err
 }
 
 // POST /api/upload  (multipart form: sender_id, receiver_id, file)
 func UploadFile(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseMultipartForm(100 << 20); err != nil { // 100MB
+	// Stream the upload to a temp file instead of buffering the form
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+maxResourceFormSize)
+	upload, err := readResourceUpload(r, func(fields map[string]string) error {
+		// Clients send the fields first, so the declared body length can be
+		// checked against the quota before the file is read
+		senderID, err := strconv.Atoi(fields["sender_id"])
+		if err != nil || r.ContentLength <= 0 {
+			return nil
+		}
+		return checkQuota(senderID, r.ContentLength)
+	})
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "file too large (max 100MB)", http.StatusRequestEntityTooLarge)
+		return
+	} else if errors.Is(err, errQuotaExceeded) {
+		writeQuotaError(w, err)
+		return
+	} else if err != nil {
 		http.Error(w, "cannot parse form", http.StatusBadRequest)
 		return
 	}
+	defer upload.discard()
 
-	senderStr := r.FormValue("sender_id")
-	receiverStr := r.FormValue("receiver_id")
+	senderStr := upload.fields["sender_id"]
+	receiverStr := upload.fields["receiver_id"]
 	if senderStr == "" || receiverStr == "" {
 		http.Error(w, "sender_id and receiver_id required", http.StatusBadRequest)
 		return
 	}
 	senderID, _ := strconv.Atoi(senderStr)
 	receiverID, _ := strconv.Atoi(receiverStr)
+	if until, suspended := suspendedUntil(senderID); suspended {
+		http.Error(w, suspensionMessage(until), http.StatusForbidden)
+		return
+	}
+	if isBlocked(senderID, receiverID) {
+		http.Error(w, "you cannot message this user", http.StatusForbidden)
+		return
+	}
 
-	fhs := r.MultipartForm.File["file"]
-	if len(fhs) == 0 {
+	if upload.tmpPath == "" {
 		http.Error(w, "file required", http.StatusBadRequest)
 		return
 	}
-	fh := fhs[0]
+	if err := checkQuota(senderID, upload.size); err != nil {
+		writeQuotaError(w, err)
+		return
+	}
 
-	os.MkdirAll("./uploads", 0755)
-	storedName, err := saveFile(fh, "./uploads")
+	mimeType, err := checkFileType(UploadKindAttachment, upload.fileName, upload.head)
+	if err != nil {
+		writeFileTypeError(w, err)
+		return
+	}
+
+	storedName, err := saveFile(upload, mimeType)
 	if err != nil {
 		http.Error(w, "save failed:"+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	stat, _ := os.Stat("./uploads/" + storedName)
-	size := stat.Size()
-	mime := fh.Header.Get("Content-Type")
+
+	sendAttachment(w, senderID, receiverID, upload.fileName, storedName, mimeType, upload.size)
+}
+
+// sendAttachment records a stored attachment as a file message and notifies
+// both sides. It is shared by direct and resumable uploads.
+func sendAttachment(w http.ResponseWriter, senderID, receiverID int, fileName, storedName, mime string, size int64) {
+	// The file and its message are created together, so a failed upload can
+	// be retried without leaving a stray file row; the stored blob is left
+	// to the janitor
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
 
 	var fileID int
-	err = db.DB.QueryRow(`INSERT INTO files(filename, stored_name, size, mime_type, uploader_id) VALUES($1,$2,$3,$4,$5) RETURNING id`,
-		fh.Filename, storedName, size, mime, senderID).Scan(&fileID)
+	err = tx.QueryRow(`INSERT INTO files(filename, stored_name, size, mime_type, uploader_id) VALUES($1,$2,$3,$4,$5) RETURNING id`,
+		fileName, storedName, size, mime, senderID).Scan(&fileID)
 	if err != nil {
 		http.Error(w, "db insert file:"+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	var created time.Time
-	err = db.DB.QueryRow(`INSERT INTO messages(sender_id, receiver_id, is_file, file_id) VALUES($1,$2,true,$3) RETURNING created_at`,
+	err = tx.QueryRow(`INSERT INTO messages(sender_id, receiver_id, is_file, file_id) VALUES($1,$2,true,$3) RETURNING created_at`,
 		senderID, receiverID, fileID).Scan(&created)
 	if err != nil {
 		http.Error(w, "db insert message:"+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A missing preview only means the full image is shown
+	if isDecodableImage(mime) && size <= maxPreviewSourceSize {
+		if err := generateFilePreview(fileID, storedName); err != nil {
+			log.Printf("Error generating preview for file %d: %v", fileID, err)
+		}
+	}
+
+	unarchiveOnActivity(senderID, receiverID)
 
 	// notify via WS
 	msg := WSMsg{
@@ -99,15 +146,20 @@ func UploadFile(w http.ResponseWriter, r *http.Request) {
 		sc.send <- msg
 	}
 
+	// Downloads are refused until the scan comes back clean
+	requestScan()
+
 	resp := map[string]interface{}{
-		"file_id":  fileID,
-		"file_url": "/uploads/" + storedName,
+		"file_id":     fileID,
+		"file_url":    signedDownloadURL(DownloadKindFile, fileID, senderID, downloadLinkTTL),
+		"scan_status": ScanStatusPending,
+		"variants":    fileVariantURLs(fileID, senderID),
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
-// GET /api/file?id=123  -> returns filename & stored_name & url
+// GET /api/file?id=123&user_id=1  -> returns filename and a signed download url
 func FileInfo(w http.ResponseWriter, r *http.Request) {
 	idStr := r.URL.Query().Get("id")
 	if idStr == "" {
@@ -115,9 +167,14 @@ func FileInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	id, _ := strconv.Atoi(idStr)
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return
+	}
 
-	var filename, stored string
-	err := db.DB.QueryRow(`SELECT filename, stored_name FROM files WHERE id=$1`, id).Scan(&filename, &stored)
+	var filename string
+	err = db.DB.QueryRow(`SELECT filename FROM files WHERE id=$1`, id).Scan(&filename)
 	if err == sql.ErrNoRows {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
@@ -126,8 +183,19 @@ func FileInfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{
+	allowed, err := canAccessFile(userID, id)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
 		"filename": filename,
-		"url":      "/uploads/" + stored,
+		"url":      signedDownloadURL(DownloadKindFile, id, userID, downloadLinkTTL),
+		"variants": fileVariantURLs(id, userID),
 	})
 }
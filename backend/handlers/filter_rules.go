@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"main/db"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rule types moderators can configure
+const (
+	FilterRuleKeyword = "keyword"
+	FilterRuleLink    = "link"
+	FilterRuleRegex   = "regex"
+)
+
+// FilterRule is one moderator-managed keyword, link or regex rule
+type FilterRule struct {
+	ID        int    `json:"id"`
+	RuleType  string `json:"rule_type"`
+	Pattern   string `json:"pattern"`
+	Verdict   string `json:"verdict"` // flag or reject
+	Enabled   bool   `json:"enabled"`
+	CreatedBy int    `json:"created_by"`
+	CreatedAt string `json:"created_at"`
+
+	re *regexp.Regexp
+}
+
+// FilterDecisionLog is one logged flag or reject
+type FilterDecisionLog struct {
+	ID        int    `json:"id"`
+	UserID    int    `json:"user_id"`
+	Username  string `json:"username"`
+	Kind      string `json:"kind"`
+	TargetID  int    `json:"target_id"`
+	Verdict   string `json:"verdict"`
+	Filter    string `json:"filter"`
+	Reason    string `json:"reason"`
+	Excerpt   string `json:"excerpt"`
+	CreatedAt string `json:"created_at"`
+}
+
+// matches checks a rule against the lowercased content, the raw content and
+// the hosts of any links in it. A link rule of "*" matches every link; other
+// link rules match the domain and its subdomains.
+func (rule *FilterRule) matches(lower, raw string, hosts []string) bool {
+	switch rule.RuleType {
+	case FilterRuleKeyword:
+		return strings.Contains(lower, rule.Pattern)
+	case FilterRuleLink:
+		for _, host := range hosts {
+			if rule.Pattern == "*" || host == rule.Pattern || strings.HasSuffix(host, "."+rule.Pattern) {
+				return true
+			}
+		}
+	case FilterRuleRegex:
+		return rule.re != nil && rule.re.MatchString(raw)
+	}
+	return false
+}
+
+// filterRuleCache holds the enabled rules so filtering does not hit the
+// database on every message
+type filterRuleCache struct {
+	mu    sync.RWMutex
+	rules []*FilterRule
+}
+
+var filterRules = &filterRuleCache{}
+
+func (c *filterRuleCache) snapshot() []*FilterRule {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.rules
+}
+
+func (c *filterRuleCache) reload() error {
+	rules, err := loadFilterRules(true)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.rules = rules
+	c.mu.Unlock()
+	return nil
+}
+
+func loadFilterRules(enabledOnly bool) ([]*FilterRule, error) {
+	rows, err := db.DB.Query(`
+		SELECT id, rule_type, pattern, verdict, enabled, COALESCE(created_by, 0), created_at
+		FROM filter_rules
+		WHERE enabled OR NOT $1
+		ORDER BY id
+	`, enabledOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := make([]*FilterRule, 0)
+	for rows.Next() {
+		rule := &FilterRule{}
+		var created time.Time
+		if err := rows.Scan(&rule.ID, &rule.RuleType, &rule.Pattern, &rule.Verdict, &rule.Enabled, &rule.CreatedBy, &created); err != nil {
+			continue
+		}
+		rule.CreatedAt = created.UTC().Format(time.RFC3339)
+		if rule.RuleType == FilterRuleRegex {
+			// Patterns are validated on save; a bad one here is skipped
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				continue
+			}
+			rule.re = re
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// GET /api/moderation/filter-rules?moderator_id=1
+func GetFilterRules(w http.ResponseWriter, r *http.Request) {
+	moderatorID, _ := strconv.Atoi(r.URL.Query().Get("moderator_id"))
+	if !isModerator(moderatorID) {
+		http.Error(w, errNotModerator.Error(), http.StatusForbidden)
+		return
+	}
+
+	rules, err := loadFilterRules(false)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// POST /api/moderation/filter-rules
+// {moderator_id, action: "add", rule_type, pattern, verdict}
+// {moderator_id, action: "enable"|"disable"|"delete", rule_id}
+// Changes take effect immediately on this instance and within a minute elsewhere.
+func UpdateFilterRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ModeratorID int    `json:"moderator_id"`
+		Action      string `json:"action"`
+		RuleID      int    `json:"rule_id"`
+		RuleType    string `json:"rule_type"`
+		Pattern     string `json:"pattern"`
+		Verdict     string `json:"verdict"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !isModerator(req.ModeratorID) {
+		http.Error(w, errNotModerator.Error(), http.StatusForbidden)
+		return
+	}
+
+	var err error
+	var res sql.Result
+	switch req.Action {
+	case "add":
+		pattern := strings.TrimSpace(req.Pattern)
+		switch req.RuleType {
+		case FilterRuleKeyword, FilterRuleLink:
+			pattern = strings.ToLower(pattern)
+		case FilterRuleRegex:
+			if _, err := regexp.Compile(pattern); err != nil {
+				http.Error(w, "invalid regex: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "rule_type must be keyword, link or regex", http.StatusBadRequest)
+			return
+		}
+		if pattern == "" {
+			http.Error(w, "pattern required", http.StatusBadRequest)
+			return
+		}
+		if req.Verdict != VerdictFlag && req.Verdict != VerdictReject {
+			http.Error(w, "verdict must be flag or reject", http.StatusBadRequest)
+			return
+		}
+		err = db.DB.QueryRow(`
+			INSERT INTO filter_rules(rule_type, pattern, verdict, created_by)
+			VALUES($1, $2, $3, $4)
+			RETURNING id
+		`, req.RuleType, pattern, req.Verdict, req.ModeratorID).Scan(&req.RuleID)
+
+	case "enable", "disable":
+		res, err = db.DB.Exec(`UPDATE filter_rules SET enabled = $1 WHERE id = $2`, req.Action == "enable", req.RuleID)
+
+	case "delete":
+		res, err = db.DB.Exec(`DELETE FROM filter_rules WHERE id = $1`, req.RuleID)
+
+	default:
+		http.Error(w, "action must be add, enable, disable or delete", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update filter rules: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if res != nil {
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "rule not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	if err := filterRules.reload(); err != nil {
+		http.Error(w, "Failed to reload filter rules: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "success",
+		"rule_id": req.RuleID,
+	})
+}
+
+// GET /api/moderation/filter-decisions?moderator_id=1[&verdict=flag][&user_id=2][&before_id=100][&limit=50]
+func GetFilterDecisions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	moderatorID, _ := strconv.Atoi(query.Get("moderator_id"))
+	if !isModerator(moderatorID) {
+		http.Error(w, errNotModerator.Error(), http.StatusForbidden)
+		return
+	}
+
+	verdict := query.Get("verdict")
+	userID, _ := strconv.Atoi(query.Get("user_id"))
+	beforeID, _ := strconv.Atoi(query.Get("before_id"))
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT d.id, d.user_id, COALESCE(u.username, ''), d.kind, COALESCE(d.target_id, 0), d.verdict,
+		       d.filter, COALESCE(d.reason, ''), COALESCE(d.excerpt, ''), d.created_at
+		FROM filter_decisions d
+		LEFT JOIN users u ON u.id = d.user_id
+		WHERE ($1 = '' OR d.verdict = $1)
+		AND ($2 = 0 OR d.user_id = $2)
+		AND ($3 = 0 OR d.id < $3)
+		ORDER BY d.id DESC
+		LIMIT $4
+	`, verdict, userID, beforeID, limit)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	decisions := make([]FilterDecisionLog, 0)
+	for rows.Next() {
+		var d FilterDecisionLog
+		var created time.Time
+		err := rows.Scan(&d.ID, &d.UserID, &d.Username, &d.Kind, &d.TargetID, &d.Verdict,
+			&d.Filter, &d.Reason, &d.Excerpt, &created)
+		if err != nil {
+			continue
+		}
+		d.CreatedAt = created.UTC().Format(time.RFC3339)
+		decisions = append(decisions, d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(decisions)
+}
@@ -53,6 +53,11 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if until, suspended := suspendedUntil(userID); suspended {
+		sendErrorResponse(w, suspensionMessage(until), http.StatusForbidden)
+		return
+	}
+
 	// (Optional) Session cookie
 	http.SetCookie(w, &http.Cookie{
 		Name:  "session_user",
@@ -120,6 +125,13 @@ func SearchUsers(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Hide users on either side of a block from the searcher
+	if excludeUserID > 0 {
+		n := "$" + strconv.Itoa(len(args))
+		sqlQuery += " AND NOT EXISTS (SELECT 1 FROM user_blocks b WHERE (b.blocker_id = " + n +
+			" AND b.blocked_id = users.id) OR (b.blocker_id = users.id AND b.blocked_id = " + n + "))"
+	}
+
 	sqlQuery += " ORDER BY username LIMIT 20"
 
 	rows, err := db.DB.Query(sqlQuery, args...)
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"main/db"
+	"main/imaging"
+	"main/storage"
+	"net/url"
+)
+
+// Image variants
+//
+// Profile photos are decoded, turned upright, stripped of metadata by
+// re-encoding and stored as a normalized original plus square avatars.
+// Chat images get a preview scaled to fit previewMaxSide. Variants are
+// recorded in image_variants; profile variants are public like the photo,
+// file variants are served through the file's signed download link with
+// ?variant=. Animated GIFs keep only their first frame.
+
+// Variant names
+const (
+	VariantOriginal = "original"
+	VariantPreview  = "preview"
+)
+
+const (
+	profilePhotoMaxSide = 1024
+	previewMaxSide      = 640
+	// Larger chat images are served without a preview
+	maxPreviewSourceSize = 25 << 20
+)
+
+// avatarSizes are the square profile photo variants, named avatar_<size>
+var avatarSizes = []int{64, 128, 256}
+
+// isDecodableImage reports whether the pure-Go decoders handle mimeType
+func isDecodableImage(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// renderedImage is an encoded variant waiting to be stored
+type renderedImage struct {
+	variant     string
+	contentType string
+	ext         string
+	data        []byte
+	width       int
+	height      int
+}
+
+func renderImage(variant string, img *image.RGBA) (renderedImage, error) {
+	data, contentType, ext, err := imaging.Encode(img)
+	return renderedImage{
+		variant:     variant,
+		contentType: contentType,
+		ext:         ext,
+		data:        data,
+		width:       img.Bounds().Dx(),
+		height:      img.Bounds().Dy(),
+	}, err
+}
+
+// renderProfilePhoto produces the normalized original followed by the avatars
+func renderProfilePhoto(data []byte) ([]renderedImage, error) {
+	img, err := imaging.Load(data, profilePhotoMaxSide)
+	if err != nil {
+		return nil, err
+	}
+	original, err := renderImage(VariantOriginal, img)
+	if err != nil {
+		return nil, err
+	}
+	out := []renderedImage{original}
+	// Every avatar is scaled from the same crop of the normalized original
+	crop := imaging.CropSquare(img)
+	for _, size := range avatarSizes {
+		avatar, err := renderImage(fmt.Sprintf("avatar_%d", size), imaging.Fit(crop, size))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, avatar)
+	}
+	return out, nil
+}
+
+// putRendered stores each image under keyFor(image) and returns the keys.
+// On failure, whatever was stored is removed again.
+func putRendered(images []renderedImage, keyFor func(renderedImage) string) ([]string, error) {
+	var keys []string
+	for _, img := range images {
+		key := keyFor(img)
+		if err := storage.Blobs.Put(key, bytes.NewReader(img.data), int64(len(img.data)), img.contentType); err != nil {
+			deleteBlobs(keys)
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func deleteBlobs(keys []string) {
+	for _, key := range keys {
+		storage.Blobs.Delete(key)
+	}
+}
+
+// generateFilePreview stores a preview of an image attachment
+func generateFilePreview(fileID int, storedName string) error {
+	rc, err := storage.Blobs.Get(storage.PrefixUploads+storedName, 0, -1)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(rc, maxPreviewSourceSize+1))
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	if len(data) > maxPreviewSourceSize {
+		return nil
+	}
+
+	img, err := imaging.Load(data, previewMaxSide)
+	if err != nil {
+		return err
+	}
+	preview, err := renderImage(VariantPreview, img)
+	if err != nil {
+		return err
+	}
+	keys, err := putRendered([]renderedImage{preview}, func(r renderedImage) string {
+		return fmt.Sprintf("%s%d/%s%s", storage.PrefixPreviews, fileID, r.variant, r.ext)
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.DB.Exec(`
+		INSERT INTO image_variants(file_id, variant, storage_key, content_type, width, height, size)
+		VALUES($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT DO NOTHING
+	`, fileID, preview.variant, keys[0], preview.contentType, preview.width, preview.height, len(preview.data))
+	if err != nil {
+		deleteBlobs(keys)
+	}
+	return err
+}
+
+// fileVariantURLs returns signed links to a file's variants for userID
+func fileVariantURLs(fileID, userID int) map[string]string {
+	urls := make(map[string]string)
+	rows, err := db.DB.Query(`SELECT variant FROM image_variants WHERE file_id = $1`, fileID)
+	if err != nil {
+		return urls
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var variant string
+		if rows.Scan(&variant) == nil {
+			urls[variant] = signedDownloadURL(DownloadKindFile, fileID, userID, downloadLinkTTL) + "&variant=" + url.QueryEscape(variant)
+		}
+	}
+	return urls
+}
+
+// profileVariantURLs returns the public avatar URLs of userID's current
+// photo. A photo set by URL through UpdateProfile has none.
+func profileVariantURLs(userID int) map[string]string {
+	urls := make(map[string]string)
+	rows, err := db.DB.Query(`
+		SELECT v.variant, v.storage_key FROM image_variants v
+		JOIN users u ON u.id = v.user_id
+		WHERE v.user_id = $1 AND v.variant <> 'original'
+		AND u.profile_photo = '/' || (
+			SELECT o.storage_key FROM image_variants o WHERE o.user_id = $1 AND o.variant = 'original'
+		)
+	`, userID)
+	if err != nil {
+		return urls
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var variant, key string
+		if rows.Scan(&variant, &key) == nil {
+			urls[variant] = "/" + key
+		}
+	}
+	return urls
+}
@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"main/db"
+	"main/storage"
+	"strings"
+	"time"
+)
+
+// The janitor reconciles blob storage with the database. It removes
+//
+//   - files rows no direct or room message points at any more, with their blob
+//   - attachments, profile photos, image variants and resource content no
+//     row refers to
+//   - chunks of upload sessions that no longer exist
+//   - partial writes left by interrupted uploads
+//
+// Anything younger than the grace period is left alone, since uploads store
+// the blob before the row that refers to it. Resource blobs that still have a
+// resource_blobs row are the blob collector's job, and expired upload
+// sessions the upload sweeper's.
+const (
+	janitorInterval    = 6 * time.Hour
+	janitorGracePeriod = 24 * time.Hour
+)
+
+// Orphan is one piece of storage the janitor found nothing referring to
+type Orphan struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	Reason       string    `json:"reason"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// JanitorReport is the outcome of one janitor run
+type JanitorReport struct {
+	DryRun       bool     `json:"dry_run"`
+	Orphans      []Orphan `json:"orphans"`
+	Removed      int      `json:"removed"`
+	RemovedBytes int64    `json:"removed_bytes"`
+	Errors       []string `json:"errors,omitempty"`
+}
+
+// OrphanBytes totals the size of everything found
+func (r *JanitorReport) OrphanBytes() int64 {
+	var total int64
+	for _, o := range r.Orphans {
+		total += o.Size
+	}
+	return total
+}
+
+func (r *JanitorReport) fail(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("Janitor: %s", msg)
+	r.Errors = append(r.Errors, msg)
+}
+
+// StartJanitor periodically removes orphaned storage
+func StartJanitor() {
+	go func() {
+		ticker := time.NewTicker(janitorInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			report := RunJanitor(janitorGracePeriod, false)
+			if len(report.Orphans) > 0 || len(report.Errors) > 0 {
+				log.Printf("Janitor removed %d of %d orphans (%d bytes), %d errors",
+					report.Removed, len(report.Orphans), report.RemovedBytes, len(report.Errors))
+			}
+		}
+	}()
+}
+
+// RunJanitor finds storage nothing refers to and, unless dryRun is set,
+// removes it. Errors are collected in the report so one bad key does not
+// stop the run.
+func RunJanitor(grace time.Duration, dryRun bool) *JanitorReport {
+	report := &JanitorReport{DryRun: dryRun, Orphans: []Orphan{}}
+	cutoff := time.Now().Add(-grace)
+
+	collectUnreferencedFiles(report, grace)
+
+	scans := []struct {
+		prefix string
+		reason string
+		query  string
+		keyOf  func(string) string
+		skip   func(string) bool
+	}{
+		{
+			prefix: storage.PrefixUploads,
+			reason: "no files row",
+			query:  `SELECT stored_name FROM files`,
+			keyOf:  func(name string) string { return storage.PrefixUploads + name },
+			skip:   func(key string) bool { return strings.HasPrefix(key, storage.PrefixProfiles) },
+		},
+		{
+			prefix: storage.PrefixProfiles,
+			reason: "not any user's profile photo",
+			query: `SELECT TRIM(LEADING '/' FROM profile_photo) FROM users WHERE profile_photo LIKE '/uploads/profiles/%'
+				UNION ALL SELECT storage_key FROM image_variants WHERE user_id IS NOT NULL`,
+			keyOf: func(key string) string { return key },
+		},
+		{
+			prefix: storage.PrefixPreviews,
+			reason: "no image_variants row",
+			query:  `SELECT storage_key FROM image_variants WHERE file_id IS NOT NULL`,
+			keyOf:  func(key string) string { return key },
+		},
+		{
+			prefix: storage.PrefixResources,
+			reason: "no resource_blobs row",
+			query:  `SELECT storage_key FROM resource_blobs`,
+			keyOf:  func(key string) string { return key },
+		},
+		{
+			prefix: storage.PrefixUploadSessions,
+			reason: "upload session no longer exists",
+			query:  `SELECT id FROM upload_sessions`,
+			keyOf:  chunkPrefix,
+		},
+	}
+
+	for _, scan := range scans {
+		// Load the references before listing so anything written after the
+		// listing starts is either referenced or inside the grace period
+		live, err := loadKeySet(scan.query, scan.keyOf)
+		if err != nil {
+			report.fail("loading references for %s: %v", scan.prefix, err)
+			continue
+		}
+		blobs, err := storage.Blobs.List(scan.prefix)
+		if err != nil {
+			report.fail("listing %s: %v", scan.prefix, err)
+			continue
+		}
+		for _, b := range blobs {
+			if b.LastModified.After(cutoff) || (scan.skip != nil && scan.skip(b.Key)) {
+				continue
+			}
+			// Chunks are referenced by their session's prefix
+			key := b.Key
+			if scan.prefix == storage.PrefixUploadSessions {
+				if id, _, ok := strings.Cut(strings.TrimPrefix(key, scan.prefix), "/"); ok {
+					key = chunkPrefix(id)
+				}
+			}
+			if live[key] {
+				continue
+			}
+			removeOrphan(report, Orphan{Key: b.Key, Size: b.Size, Reason: scan.reason, LastModified: b.LastModified})
+		}
+	}
+
+	if pl, ok := storage.Blobs.(storage.PartialLister); ok {
+		for _, prefix := range []string{storage.PrefixUploads, storage.PrefixResources, storage.PrefixPreviews, storage.PrefixUploadSessions} {
+			partial, err := pl.ListPartial(prefix)
+			if err != nil {
+				report.fail("listing partial writes under %s: %v", prefix, err)
+				continue
+			}
+			for _, b := range partial {
+				if b.LastModified.Before(cutoff) {
+					removeOrphan(report, Orphan{Key: b.Key, Size: b.Size, Reason: "interrupted upload", LastModified: b.LastModified})
+				}
+			}
+		}
+	}
+
+	return report
+}
+
+// collectUnreferencedFiles removes attachment rows whose messages are gone,
+// for example after delete-for-everyone or message expiry
+func collectUnreferencedFiles(report *JanitorReport, grace time.Duration) {
+	const unreferenced = `
+		NOT EXISTS (SELECT 1 FROM messages m WHERE m.file_id = f.id)
+		AND NOT EXISTS (SELECT 1 FROM resource_messages rm WHERE rm.file_id = f.id)
+	`
+	rows, err := db.DB.Query(`
+		SELECT f.id, f.stored_name, f.size, f.created_at FROM files f
+		WHERE f.created_at < NOW() - make_interval(secs => $1) AND `+unreferenced,
+		grace.Seconds())
+	if err != nil {
+		report.fail("listing unreferenced files: %v", err)
+		return
+	}
+	type fileRow struct {
+		id     int
+		orphan Orphan
+	}
+	var found []fileRow
+	for rows.Next() {
+		var f fileRow
+		var storedName string
+		if err := rows.Scan(&f.id, &storedName, &f.orphan.Size, &f.orphan.LastModified); err != nil {
+			continue
+		}
+		f.orphan.Key = storage.PrefixUploads + storedName
+		f.orphan.Reason = "no message refers to this file"
+		found = append(found, f)
+	}
+	rows.Close()
+
+	for _, f := range found {
+		if report.DryRun {
+			report.Orphans = append(report.Orphans, f.orphan)
+			continue
+		}
+		// Re-check in the delete itself in case a message picked it up
+		res, err := db.DB.Exec(`DELETE FROM files f WHERE f.id = $1 AND `+unreferenced, f.id)
+		if err != nil {
+			report.fail("deleting file %d: %v", f.id, err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		removeOrphan(report, f.orphan)
+	}
+}
+
+// loadKeySet runs a single-column query and maps each value to a key
+func loadKeySet(query string, keyOf func(string) string) (map[string]bool, error) {
+	rows, err := db.DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make(map[string]bool)
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		keys[keyOf(v)] = true
+	}
+	return keys, rows.Err()
+}
+
+// removeOrphan records o and deletes it unless this is a dry run
+func removeOrphan(report *JanitorReport, o Orphan) {
+	report.Orphans = append(report.Orphans, o)
+	if report.DryRun {
+		return
+	}
+	if err := storage.Blobs.Delete(o.Key); err != nil {
+		report.fail("deleting %s: %v", o.Key, err)
+		return
+	}
+	report.Removed++
+	report.RemovedBytes += o.Size
+}
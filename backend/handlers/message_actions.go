@@ -0,0 +1,377 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"main/db"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Edit/delete message types. Clients send edit and delete; the server
+// answers with message_updated and message_deleted events.
+const (
+	MsgTypeEdit           = "edit"
+	MsgTypeDelete         = "delete"
+	MsgTypeMessageUpdated = "message_updated"
+	MsgTypeMessageDeleted = "message_deleted"
+)
+
+// Delete scopes
+const (
+	DeleteForMe       = "me"
+	DeleteForEveryone = "everyone"
+)
+
+var (
+	errMessageNotFound = errors.New("message not found")
+	errNotParticipant  = errors.New("not a participant in this conversation")
+	errNotSender       = errors.New("only the sender can do that")
+	errMessageDeleted  = errors.New("message has been deleted")
+	errMessageRemoved  = errors.New("message was removed by a moderator")
+	errMessageNotSent  = errors.New("message has not been sent yet")
+	errNotEditable     = errors.New("message cannot be edited")
+)
+
+// suspensionError refuses an action by a suspended user
+type suspensionError struct {
+	until time.Time
+}
+
+func (e *suspensionError) Error() string {
+	return suspensionMessage(e.until)
+}
+
+// MessageUpdate is the payload of message_updated and message_deleted events
+type MessageUpdate struct {
+	MessageID  int    `json:"message_id"`
+	SenderID   int    `json:"sender_id"`
+	ReceiverID int    `json:"receiver_id"`
+	Content    string `json:"content,omitempty"`
+	EditedAt   string `json:"edited_at,omitempty"`
+	Scope      string `json:"scope,omitempty"`
+}
+
+// MessageEdit is one previous version of an edited message
+type MessageEdit struct {
+	PreviousContent string `json:"previous_content"`
+	EditedAt        string `json:"edited_at"`
+}
+
+// editMessage replaces the content of a text message, keeping the old
+// version in message_edits
+func editMessage(userID, messageID int, content string) (*MessageUpdate, error) {
+	if strings.TrimSpace(content) == "" {
+		return nil, errNotEditable
+	}
+	if until, suspended := suspendedUntil(userID); suspended {
+		return nil, &suspensionError{until: until}
+	}
+	if d := filterContent(FilterInput{Kind: FilterKindEdit, SenderID: userID, Content: content}); d.Verdict == VerdictReject {
+		return nil, &filterRejection{decision: d}
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	update := &MessageUpdate{MessageID: messageID, Content: content}
+	var previous string
+	var isFile, released, encrypted bool
+	var deletedAt, removedAt sql.NullTime
+	err = tx.QueryRow(`
+		SELECT sender_id, receiver_id, COALESCE(content, ''), is_file, deleted_at, removed_at, released, encrypted
+		FROM messages WHERE id = $1
+		FOR UPDATE
+	`, messageID).Scan(&update.SenderID, &update.ReceiverID, &previous, &isFile, &deletedAt, &removedAt, &released, &encrypted)
+	if err == sql.ErrNoRows {
+		return nil, errMessageNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if update.SenderID != userID {
+		return nil, errNotSender
+	}
+	if deletedAt.Valid {
+		return nil, errMessageDeleted
+	}
+	if removedAt.Valid {
+		return nil, errMessageRemoved
+	}
+	// The server cannot re-encrypt, so encrypted messages are delete-only
+	if isFile || encrypted {
+		return nil, errNotEditable
+	}
+
+	if _, err := tx.Exec(`INSERT INTO message_edits(message_id, previous_content) VALUES($1, $2)`, messageID, previous); err != nil {
+		return nil, err
+	}
+
+	var editedAt time.Time
+	err = tx.QueryRow(`UPDATE messages SET content = $1, edited_at = NOW() WHERE id = $2 RETURNING edited_at`,
+		content, messageID).Scan(&editedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	update.EditedAt = editedAt.UTC().Format(time.RFC3339)
+	notifyMessageParticipants(MsgTypeMessageUpdated, userID, update, visibleTo(update, released)...)
+	return update, nil
+}
+
+// deleteMessage hides a message for the caller, or tombstones it for both
+// participants when scope is everyone
+func deleteMessage(userID, messageID int, scope string) (*MessageUpdate, error) {
+	if scope == "" {
+		scope = DeleteForMe
+	}
+
+	update := &MessageUpdate{MessageID: messageID, Scope: scope}
+	var deletedAt sql.NullTime
+	var released bool
+	err := db.DB.QueryRow(`SELECT sender_id, receiver_id, deleted_at, released FROM messages WHERE id = $1`, messageID).
+		Scan(&update.SenderID, &update.ReceiverID, &deletedAt, &released)
+	if err == sql.ErrNoRows {
+		return nil, errMessageNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if userID != update.SenderID && userID != update.ReceiverID {
+		return nil, errNotParticipant
+	}
+
+	switch scope {
+	case DeleteForMe:
+		_, err = db.DB.Exec(`
+			INSERT INTO message_hidden(message_id, user_id) VALUES($1, $2)
+			ON CONFLICT (message_id, user_id) DO NOTHING
+		`, messageID, userID)
+		if err != nil {
+			return nil, err
+		}
+		notifyMessageParticipants(MsgTypeMessageDeleted, userID, update, userID)
+
+	case DeleteForEveryone:
+		if userID != update.SenderID {
+			return nil, errNotSender
+		}
+		if deletedAt.Valid {
+			return nil, errMessageDeleted
+		}
+
+		// Keep the row as a tombstone so replies and ordering stay intact
+		_, err = db.DB.Exec(`
+			UPDATE messages SET deleted_at = NOW(), content = NULL, file_id = NULL, ciphertext = NULL, e2ee_header = NULL
+			WHERE id = $1
+		`, messageID)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := db.DB.Exec(`DELETE FROM message_edits WHERE message_id = $1`, messageID); err != nil {
+			return nil, err
+		}
+		notifyMessageParticipants(MsgTypeMessageDeleted, userID, update, visibleTo(update, released)...)
+
+	default:
+		return nil, errors.New("scope must be me or everyone")
+	}
+
+	return update, nil
+}
+
+// visibleTo returns who can see a message: scheduled messages that have not
+// been sent yet exist only for their sender
+func visibleTo(update *MessageUpdate, released bool) []int {
+	if !released {
+		return []int{update.SenderID}
+	}
+	return []int{update.SenderID, update.ReceiverID}
+}
+
+// notifyMessageParticipants pushes a message event to each connected recipient
+func notifyMessageParticipants(msgType string, actorID int, update *MessageUpdate, recipients ...int) {
+	message := UnifiedMessage{
+		Type:       msgType,
+		UserID:     actorID,
+		ReceiverID: update.ReceiverID,
+		MessageID:  update.MessageID,
+		Content:    update.Content,
+		Data:       update,
+		Timestamp:  time.Now(),
+	}
+	for _, userID := range recipients {
+		unifiedManager.sendToUser(userID, message)
+	}
+}
+
+// validReplyTarget checks that replyToID belongs to the conversation between
+// the two users
+func validReplyTarget(replyToID, userA, userB int) bool {
+	var ok bool
+	err := db.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM messages
+			WHERE id = $1 AND ((sender_id = $2 AND receiver_id = $3) OR (sender_id = $3 AND receiver_id = $2))
+		)
+	`, replyToID, userA, userB).Scan(&ok)
+	return err == nil && ok
+}
+
+// messageActionStatus maps an edit/delete error to a socket error code and
+// HTTP status
+func messageActionStatus(err error) (string, int) {
+	if rejection, ok := err.(*filterRejection); ok {
+		return ErrCodeRejected, rejectionStatus(rejection.decision)
+	}
+	if _, ok := err.(*suspensionError); ok {
+		return ErrCodeForbidden, http.StatusForbidden
+	}
+	switch err {
+	case errMessageNotFound:
+		return ErrCodeNotFound, http.StatusNotFound
+	case errNotParticipant, errNotSender, errMessageRemoved:
+		return ErrCodeForbidden, http.StatusForbidden
+	case errMessageDeleted, errMessageNotSent:
+		return ErrCodeInvalidMessage, http.StatusConflict
+	default:
+		return ErrCodeInvalidMessage, http.StatusBadRequest
+	}
+}
+
+func (c *UnifiedClient) handleEdit(message UnifiedMessage) {
+	if _, err := editMessage(c.userID, message.MessageID, message.Content); err != nil {
+		code, _ := messageActionStatus(err)
+		c.sendError(code, err.Error(), message.Type)
+	}
+}
+
+func (c *UnifiedClient) handleDelete(message UnifiedMessage) {
+	if _, err := deleteMessage(c.userID, message.MessageID, message.Scope); err != nil {
+		code, _ := messageActionStatus(err)
+		c.sendError(code, err.Error(), message.Type)
+	}
+}
+
+// POST /api/messages/edit  {user_id, message_id, content}
+func EditMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		UserID    int    `json:"user_id"`
+		MessageID int    `json:"message_id"`
+		Content   string `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	update, err := editMessage(req.UserID, req.MessageID, req.Content)
+	if err != nil {
+		_, status := messageActionStatus(err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(update)
+}
+
+// POST /api/messages/delete  {user_id, message_id, scope: "me"|"everyone"}
+func DeleteMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		UserID    int    `json:"user_id"`
+		MessageID int    `json:"message_id"`
+		Scope     string `json:"scope"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	update, err := deleteMessage(req.UserID, req.MessageID, req.Scope)
+	if err != nil {
+		_, status := messageActionStatus(err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(update)
+}
+
+// GET /api/messages/edits?user_id=1&message_id=2
+func GetMessageEdits(w http.ResponseWriter, r *http.Request) {
+	userID, err1 := strconv.Atoi(r.URL.Query().Get("user_id"))
+	messageID, err2 := strconv.Atoi(r.URL.Query().Get("message_id"))
+	if err1 != nil || err2 != nil {
+		http.Error(w, "user_id and message_id required", http.StatusBadRequest)
+		return
+	}
+
+	// Removed messages keep their history hidden, and a scheduled message
+	// does not exist for the receiver until it is released
+	var senderID, receiverID int
+	var released bool
+	err := db.DB.QueryRow(`SELECT sender_id, receiver_id, released FROM messages WHERE id = $1 AND removed_at IS NULL`,
+		messageID).Scan(&senderID, &receiverID, &released)
+	if err == nil && !released && userID != senderID {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if userID != senderID && userID != receiverID {
+		http.Error(w, errNotParticipant.Error(), http.StatusForbidden)
+		return
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT COALESCE(previous_content, ''), edited_at
+		FROM message_edits
+		WHERE message_id = $1
+		ORDER BY edited_at ASC, id ASC
+	`, messageID)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	edits := make([]MessageEdit, 0)
+	for rows.Next() {
+		var edit MessageEdit
+		var editedAt time.Time
+		if err := rows.Scan(&edit.PreviousContent, &editedAt); err != nil {
+			continue
+		}
+		edit.EditedAt = editedAt.UTC().Format(time.RFC3339)
+		edits = append(edits, edit)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(edits)
+}
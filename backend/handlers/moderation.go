@@ -0,0 +1,442 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"main/db"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MsgTypeModerationNotice tells a user about a warning or suspension
+const MsgTypeModerationNotice = "moderation_notice"
+
+// Report targets, reasons and statuses
+const (
+	ReportTargetMessage  = "message"
+	ReportTargetUser     = "user"
+	ReportTargetResource = "resource"
+
+	ReportStatusOpen      = "open"
+	ReportStatusDismissed = "dismissed"
+	ReportStatusActioned  = "actioned"
+)
+
+// Moderator actions
+const (
+	ModActionDismiss = "dismiss"
+	ModActionRemove  = "remove"
+	ModActionWarn    = "warn"
+	ModActionSuspend = "suspend"
+)
+
+const (
+	defaultSuspendDays = 7
+	maxReportDetails   = 2000
+	maxReportEvidence  = 10
+)
+
+var (
+	validReportReasons = map[string]bool{"spam": true, "abuse": true, "copyright": true, "other": true}
+
+	errReportTargetNotFound = errors.New("reported content not found")
+	errAlreadyReported      = errors.New("you already have an open report for this")
+	errNotModerator         = errors.New("moderator role required")
+)
+
+// ContentReport is one report as shown in the moderation queue
+type ContentReport struct {
+	ID            int             `json:"id"`
+	ReporterID    int             `json:"reporter_id"`
+	ReporterName  string          `json:"reporter_username"`
+	TargetType    string          `json:"target_type"`
+	TargetID      int             `json:"target_id"`
+	TargetUserID  int             `json:"target_user_id"`
+	TargetPreview string          `json:"target_preview"`
+	Reason        string          `json:"reason"`
+	Details       string          `json:"details"`
+	Evidence      json.RawMessage `json:"evidence"`
+	Status        string          `json:"status"`
+	ReportCount   int             `json:"report_count"` // open reports on the same target
+	CreatedAt     string          `json:"created_at"`
+	ReviewedBy    *int            `json:"reviewed_by,omitempty"`
+	ReviewedAt    *string         `json:"reviewed_at,omitempty"`
+}
+
+// ModerationNotice is the payload of a moderation_notice event
+type ModerationNotice struct {
+	Action         string `json:"action"`
+	Reason         string `json:"reason"`
+	SuspendedUntil string `json:"suspended_until,omitempty"`
+}
+
+// isModerator reports whether userID may use the moderation queue
+func isModerator(userID int) bool {
+	var role string
+	db.DB.QueryRow(`SELECT role FROM users WHERE id = $1`, userID).Scan(&role)
+	return role == "moderator" || role == "admin"
+}
+
+// isAdmin reports whether userID may change site-wide settings such as quotas
+func isAdmin(userID int) bool {
+	var role string
+	db.DB.QueryRow(`SELECT role FROM users WHERE id = $1`, userID).Scan(&role)
+	return role == "admin"
+}
+
+// suspendedUntil returns the end of an active suspension, if any
+func suspendedUntil(userID int) (time.Time, bool) {
+	var until sql.NullTime
+	err := db.DB.QueryRow(`SELECT suspended_until FROM users WHERE id = $1 AND suspended_until > NOW()`, userID).Scan(&until)
+	if err != nil || !until.Valid {
+		return time.Time{}, false
+	}
+	return until.Time, true
+}
+
+// suspensionMessage is the error shown to a suspended user
+func suspensionMessage(until time.Time) string {
+	return "account suspended until " + until.UTC().Format(time.RFC3339)
+}
+
+// reportTargetOwner resolves who is responsible for a piece of content
+func reportTargetOwner(targetType string, targetID int) (int, error) {
+	var ownerID int
+	var err error
+	switch targetType {
+	case ReportTargetMessage:
+		err = db.DB.QueryRow(`SELECT sender_id FROM messages WHERE id = $1 AND deleted_at IS NULL`, targetID).Scan(&ownerID)
+	case ReportTargetResource:
+		err = db.DB.QueryRow(`SELECT uploader_id FROM resources WHERE id = $1`, targetID).Scan(&ownerID)
+	case ReportTargetUser:
+		err = db.DB.QueryRow(`SELECT id FROM users WHERE id = $1`, targetID).Scan(&ownerID)
+	default:
+		return 0, errors.New("target_type must be message, user or resource")
+	}
+	if err == sql.ErrNoRows {
+		return 0, errReportTargetNotFound
+	}
+	return ownerID, err
+}
+
+// POST /api/reports  {reporter_id, target_type, target_id, reason, details, evidence}
+// evidence is free-form JSON, typically a list of message ids or URLs.
+func CreateReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ReporterID int               `json:"reporter_id"`
+		TargetType string            `json:"target_type"`
+		TargetID   int               `json:"target_id"`
+		Reason     string            `json:"reason"`
+		Details    string            `json:"details"`
+		Evidence   []json.RawMessage `json:"evidence"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.ReporterID == 0 || req.TargetID == 0 {
+		http.Error(w, "reporter_id and target_id are required", http.StatusBadRequest)
+		return
+	}
+	if !validReportReasons[req.Reason] {
+		http.Error(w, "reason must be spam, abuse, copyright or other", http.StatusBadRequest)
+		return
+	}
+	req.Details = strings.TrimSpace(req.Details)
+	if len(req.Details) > maxReportDetails {
+		http.Error(w, fmt.Sprintf("details must be at most %d characters", maxReportDetails), http.StatusBadRequest)
+		return
+	}
+	if len(req.Evidence) > maxReportEvidence {
+		http.Error(w, fmt.Sprintf("at most %d evidence items", maxReportEvidence), http.StatusBadRequest)
+		return
+	}
+
+	ownerID, err := reportTargetOwner(req.TargetType, req.TargetID)
+	if err == errReportTargetNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ownerID == req.ReporterID {
+		http.Error(w, "cannot report your own content", http.StatusBadRequest)
+		return
+	}
+
+	// Messages can only be reported by the person who received them
+	if req.TargetType == ReportTargetMessage {
+		var receiverID int
+		db.DB.QueryRow(`SELECT receiver_id FROM messages WHERE id = $1`, req.TargetID).Scan(&receiverID)
+		if receiverID != req.ReporterID {
+			http.Error(w, errNotParticipant.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	evidence := []byte("[]")
+	if len(req.Evidence) > 0 {
+		evidence, _ = json.Marshal(req.Evidence)
+	}
+
+	var reportID int
+	err = db.DB.QueryRow(`
+		INSERT INTO content_reports(reporter_id, target_type, target_id, target_user_id, reason, details, evidence)
+		VALUES($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (reporter_id, target_type, target_id) WHERE status = 'open' DO NOTHING
+		RETURNING id
+	`, req.ReporterID, req.TargetType, req.TargetID, ownerID, req.Reason, req.Details, string(evidence)).Scan(&reportID)
+	if err == sql.ErrNoRows {
+		http.Error(w, errAlreadyReported.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to create report: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Report %d: user %d reported %s %d (%s)", reportID, req.ReporterID, req.TargetType, req.TargetID, req.Reason)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    "success",
+		"report_id": reportID,
+	})
+}
+
+// GET /api/moderation/reports?moderator_id=1[&status=open][&target_type=message][&before_id=100][&limit=50]
+func GetModerationQueue(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	moderatorID, _ := strconv.Atoi(query.Get("moderator_id"))
+	if !isModerator(moderatorID) {
+		http.Error(w, errNotModerator.Error(), http.StatusForbidden)
+		return
+	}
+
+	status := query.Get("status")
+	if status == "" {
+		status = ReportStatusOpen
+	}
+	targetType := query.Get("target_type")
+	beforeID, _ := strconv.Atoi(query.Get("before_id"))
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT cr.id, cr.reporter_id, COALESCE(ru.username, ''), cr.target_type, cr.target_id,
+		       COALESCE(cr.target_user_id, 0),
+		       CASE cr.target_type
+		         WHEN 'message' THEN (SELECT COALESCE(m.content, '[file]') FROM messages m WHERE m.id = cr.target_id)
+		         WHEN 'resource' THEN (SELECT res.title FROM resources res WHERE res.id = cr.target_id)
+		         WHEN 'user' THEN (SELECT u.username FROM users u WHERE u.id = cr.target_id)
+		       END,
+		       cr.reason, COALESCE(cr.details, ''), COALESCE(cr.evidence, '[]'::jsonb), cr.status,
+		       (SELECT COUNT(*) FROM content_reports o
+		        WHERE o.target_type = cr.target_type AND o.target_id = cr.target_id AND o.status = 'open'),
+		       cr.created_at, cr.reviewed_by, cr.reviewed_at
+		FROM content_reports cr
+		LEFT JOIN users ru ON ru.id = cr.reporter_id
+		WHERE cr.status = $1
+		AND ($2 = '' OR cr.target_type = $2)
+		AND ($3 = 0 OR cr.id < $3)
+		ORDER BY cr.id DESC
+		LIMIT $4
+	`, status, targetType, beforeID, limit)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	reports := make([]ContentReport, 0)
+	for rows.Next() {
+		var rep ContentReport
+		var preview sql.NullString
+		var evidence []byte
+		var created time.Time
+		var reviewedBy sql.NullInt32
+		var reviewedAt sql.NullTime
+		err := rows.Scan(&rep.ID, &rep.ReporterID, &rep.ReporterName, &rep.TargetType, &rep.TargetID,
+			&rep.TargetUserID, &preview, &rep.Reason, &rep.Details, &evidence, &rep.Status,
+			&rep.ReportCount, &created, &reviewedBy, &reviewedAt)
+		if err != nil {
+			continue
+		}
+		rep.TargetPreview = preview.String
+		rep.Evidence = json.RawMessage(evidence)
+		rep.CreatedAt = created.UTC().Format(time.RFC3339)
+		if reviewedBy.Valid {
+			v := int(reviewedBy.Int32)
+			rep.ReviewedBy = &v
+		}
+		if reviewedAt.Valid {
+			v := reviewedAt.Time.UTC().Format(time.RFC3339)
+			rep.ReviewedAt = &v
+		}
+		reports = append(reports, rep)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+// POST /api/moderation/action  {moderator_id, report_id, action, note, suspend_days}
+// remove takes the content down; warn and suspend act on its owner. Every
+// action except dismiss closes all open reports on the same target.
+func ModerateReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ModeratorID int    `json:"moderator_id"`
+		ReportID    int    `json:"report_id"`
+		Action      string `json:"action"`
+		Note        string `json:"note"`
+		SuspendDays int    `json:"suspend_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !isModerator(req.ModeratorID) {
+		http.Error(w, errNotModerator.Error(), http.StatusForbidden)
+		return
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var targetType, status string
+	var targetID int
+	var targetUserID sql.NullInt32
+	err = tx.QueryRow(`
+		SELECT target_type, target_id, target_user_id, status
+		FROM content_reports WHERE id = $1
+		FOR UPDATE
+	`, req.ReportID).Scan(&targetType, &targetID, &targetUserID, &status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "report not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if status != ReportStatusOpen {
+		http.Error(w, "report already reviewed", http.StatusConflict)
+		return
+	}
+	ownerID := int(targetUserID.Int32)
+
+	var expiresAt interface{}
+	var notice *ModerationNotice
+	resolution := ReportStatusActioned
+
+	switch req.Action {
+	case ModActionDismiss:
+		resolution = ReportStatusDismissed
+
+	case ModActionRemove:
+		switch targetType {
+		case ReportTargetMessage:
+			_, err = tx.Exec(`UPDATE messages SET removed_at = NOW() WHERE id = $1 AND removed_at IS NULL`, targetID)
+		case ReportTargetResource:
+			_, err = tx.Exec(`UPDATE resources SET removed_at = NOW() WHERE id = $1 AND removed_at IS NULL`, targetID)
+		default:
+			http.Error(w, "profiles cannot be removed; warn or suspend the user instead", http.StatusBadRequest)
+			return
+		}
+
+	case ModActionWarn:
+		notice = &ModerationNotice{Action: ModActionWarn, Reason: req.Note}
+
+	case ModActionSuspend:
+		days := req.SuspendDays
+		if days <= 0 {
+			days = defaultSuspendDays
+		}
+		until := time.Now().AddDate(0, 0, days)
+		expiresAt = until
+		_, err = tx.Exec(`
+			UPDATE users SET suspended_until = GREATEST(COALESCE(suspended_until, $2), $2), suspension_reason = $3
+			WHERE id = $1
+		`, ownerID, until, req.Note)
+		notice = &ModerationNotice{
+			Action:         ModActionSuspend,
+			Reason:         req.Note,
+			SuspendedUntil: until.UTC().Format(time.RFC3339),
+		}
+
+	default:
+		http.Error(w, "action must be dismiss, remove, warn or suspend", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to apply action: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO moderation_actions(moderator_id, report_id, action, target_type, target_id, target_user_id, note, expires_at)
+		VALUES($1, $2, $3, $4, $5, NULLIF($6, 0), $7, $8)
+	`, req.ModeratorID, req.ReportID, req.Action, targetType, targetID, ownerID, req.Note, expiresAt)
+	if err != nil {
+		http.Error(w, "Failed to record action: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A dismissal only closes this report; acting on the content closes them all
+	closeQuery := `
+		UPDATE content_reports SET status = $1, reviewed_by = $2, reviewed_at = NOW()
+		WHERE status = 'open' AND target_type = $3 AND target_id = $4`
+	args := []interface{}{resolution, req.ModeratorID, targetType, targetID}
+	if req.Action == ModActionDismiss {
+		closeQuery += " AND id = $5"
+		args = append(args, req.ReportID)
+	}
+	res, err := tx.Exec(closeQuery, args...)
+	if err != nil {
+		http.Error(w, "Failed to close reports: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	closed, _ := res.RowsAffected()
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if notice != nil && ownerID != 0 {
+		unifiedManager.sendToUser(ownerID, UnifiedMessage{
+			Type:      MsgTypeModerationNotice,
+			UserID:    ownerID,
+			Data:      notice,
+			Timestamp: time.Now(),
+		})
+	}
+	log.Printf("Moderator %d applied %s to %s %d (report %d)", req.ModeratorID, req.Action, targetType, targetID, req.ReportID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":         "success",
+		"action":         req.Action,
+		"reports_closed": closed,
+	})
+}
@@ -5,12 +5,12 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"main/db"
+	"main/storage"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -83,6 +83,8 @@ type Resource struct {
 	CreatedAt       time.Time `json:"created_at"`
 	Username        string    `json:"username,omitempty"`
 	Name            string    `json:"name,omitempty"`
+	Deduplicated    bool      `json:"deduplicated,omitempty"` // content was already stored
+	ScanStatus      string    `json:"scan_status"`
 }
 
 type SwarmStats struct {
@@ -106,17 +108,42 @@ type PeerInfo struct {
 
 // POST /api/p2p/resource/create
 func CreateResource(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseMultipartForm(500 << 20); err != nil { // 500MB limit
-		http.Error(w, "cannot parse form", http.StatusBadRequest)
+	// Stream the upload to a temp file, hashing it on the way
+	r.Body = http.MaxBytesReader(w, r.Body, maxResourceSize+maxResourceFormSize+1<<20)
+	upload, err := readResourceUpload(r, func(fields map[string]string) error {
+		// Clients send the fields first, so the declared body length can be
+		// checked against the quota before the file is read
+		uploaderID, err := strconv.Atoi(fields["uploader_id"])
+		if err != nil || r.ContentLength <= 0 {
+			return nil
+		}
+		return checkQuota(uploaderID, r.ContentLength)
+	})
+	if err == errResourceTooLarge {
+		http.Error(w, "file too large (max 500MB)", http.StatusRequestEntityTooLarge)
+		return
+	} else if errors.Is(err, errQuotaExceeded) {
+		writeQuotaError(w, err)
+		return
+	} else if err != nil {
+		http.Error(w, "cannot parse form: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	defer upload.discard()
 
-	title := r.FormValue("title")
-	description := r.FormValue("description")
-	skillCategory := r.FormValue("skill_category")
-	tagsStr := r.FormValue("tags")
-	difficultyLevel := r.FormValue("difficulty_level")
-	uploaderIDStr := r.FormValue("uploader_id")
+	createResourceFromUpload(w, upload)
+}
+
+// createResourceFromUpload validates the form fields of a spooled upload,
+// stores its content and creates the resource, torrent and swarm. It is
+// shared by direct and resumable uploads.
+func createResourceFromUpload(w http.ResponseWriter, upload *resourceUpload) {
+	title := upload.fields["title"]
+	description := upload.fields["description"]
+	skillCategory := upload.fields["skill_category"]
+	tagsStr := upload.fields["tags"]
+	difficultyLevel := upload.fields["difficulty_level"]
+	uploaderIDStr := upload.fields["uploader_id"]
 
 	if title == "" || skillCategory == "" || uploaderIDStr == "" {
 		http.Error(w, "title, skill_category, and uploader_id required", http.StatusBadRequest)
@@ -128,65 +155,53 @@ func CreateResource(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid uploader_id", http.StatusBadRequest)
 		return
 	}
-
-	// Handle file upload
-	fhs := r.MultipartForm.File["file"]
-	if len(fhs) == 0 {
-		http.Error(w, "file required", http.StatusBadRequest)
+	if until, suspended := suspendedUntil(uploaderID); suspended {
+		http.Error(w, suspensionMessage(until), http.StatusForbidden)
 		return
 	}
-	fh := fhs[0]
 
-	// Create uploads directory if it doesn't exist
-	os.MkdirAll("./p2p_resources", 0755)
-
-	// Save file and calculate hash
-	filePath := filepath.Join("./p2p_resources", fh.Filename)
-	file, err := fh.Open()
-	if err != nil {
-		http.Error(w, "cannot open file", http.StatusInternalServerError)
+	if upload.tmpPath == "" {
+		http.Error(w, "file required", http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
-
-	// Calculate file hash
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, file); err != nil {
-		http.Error(w, "hash calculation failed", http.StatusInternalServerError)
+	if err := checkQuota(uploaderID, upload.size); err != nil {
+		writeQuotaError(w, err)
 		return
 	}
-	fileHash := hex.EncodeToString(hasher.Sum(nil))
-
-	// Reset file pointer and save to disk
-	file.Seek(0, 0)
-	outFile, err := os.Create(filePath)
+	mimeType, err := checkFileType(UploadKindResource, upload.fileName, upload.head)
 	if err != nil {
-		http.Error(w, "cannot save file", http.StatusInternalServerError)
+		writeFileTypeError(w, err)
 		return
 	}
-	defer outFile.Close()
+	fileHash := upload.fileHash
+	fileSize := upload.size
+	pieceSize := int64(resourcePieceSize)
+	pieceCount := len(upload.pieceHashes)
+	piecesHash := strings.Join(upload.pieceHashes, ",")
+	fileName := upload.fileName
 
-	fileSize, err := io.Copy(outFile, file)
+	// Store the content once per hash; identical uploads share the blob
+	deduplicated, err := acquireResourceBlob(fileHash, fileSize, mimeType, upload.tmpPath)
 	if err != nil {
 		http.Error(w, "file save failed", http.StatusInternalServerError)
 		return
 	}
 
-	// Split file into pieces and calculate piece hashes
-	pieceSize := int64(1024 * 1024) // 1MB pieces
-	pieceCount := int((fileSize + pieceSize - 1) / pieceSize)
-	pieceHashes := make([]string, pieceCount)
-
-	file.Seek(0, 0)
-	for i := range pieceCount {
-		pieceHasher := sha256.New()
-		pieceBuffer := make([]byte, pieceSize)
-		n, _ := file.Read(pieceBuffer)
-		pieceHasher.Write(pieceBuffer[:n])
-		pieceHashes[i] = hex.EncodeToString(pieceHasher.Sum(nil))
+	// The resource and its swarm are created together, so a failed upload
+	// leaves nothing behind and can be retried. Until then the blob
+	// reference is given back on every error.
+	committed := false
+	defer func() {
+		if !committed {
+			releaseResourceBlob(db.DB, fileHash)
+		}
+	}()
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "database error: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
-
-	piecesHash := strings.Join(pieceHashes, ",")
+	defer tx.Rollback()
 
 	// Parse tags
 	var tags []string
@@ -199,11 +214,11 @@ func CreateResource(w http.ResponseWriter, r *http.Request) {
 
 	// Insert resource into database
 	var resourceID int
-	err = db.DB.QueryRow(`
+	err = tx.QueryRow(`
 		INSERT INTO resources(title, description, skill_category, file_hash, file_name, file_size, mime_type, 
 			uploader_id, piece_count, piece_size, pieces_hash, tags, difficulty_level)
 		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) RETURNING id`,
-		title, description, skillCategory, fileHash, fh.Filename, fileSize, fh.Header.Get("Content-Type"),
+		title, description, skillCategory, fileHash, fileName, fileSize, mimeType,
 		uploaderID, pieceCount, int(pieceSize), piecesHash, tags, difficultyLevel).Scan(&resourceID)
 
 	if err != nil {
@@ -212,7 +227,7 @@ func CreateResource(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create torrent entry
-	_, err = db.DB.Exec(`
+	_, err = tx.Exec(`
 		INSERT INTO torrents(resource_id, announce_url, piece_hashes, created_by)
 		VALUES($1, $2, $3, $4)`,
 		resourceID, "/api/p2p/announce", piecesHash, uploaderID)
@@ -223,7 +238,7 @@ func CreateResource(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Initialize swarm
-	_, err = db.DB.Exec(`
+	_, err = tx.Exec(`
 		INSERT INTO swarms(resource_id, total_seeders, total_leechers, total_completed)
 		VALUES($1, 1, 0, 0)`,
 		resourceID)
@@ -240,7 +255,7 @@ func CreateResource(w http.ResponseWriter, r *http.Request) {
 	}
 	piecesHaveStr := "[" + strings.Join(piecesArray, ",") + "]"
 
-	_, err = db.DB.Exec(`
+	_, err = tx.Exec(`
 		INSERT INTO peer_participation(user_id, resource_id, status, progress, pieces_have, uploaded_total, downloaded_total)
 		VALUES($1, $2, 'seeding', 100.0, $3, $4, 0)`,
 		uploaderID, resourceID, piecesHaveStr, fileSize)
@@ -250,6 +265,12 @@ func CreateResource(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "database error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	committed = true
+
 	// Return resource info
 	resource := Resource{
 		ID:              resourceID,
@@ -258,7 +279,7 @@ func CreateResource(w http.ResponseWriter, r *http.Request) {
 		SkillCategory:   skillCategory,
 		FileHash:        fileHash,
 		FileSize:        fileSize,
-		MimeType:        fh.Header.Get("Content-Type"),
+		MimeType:        mimeType,
 		UploaderID:      uploaderID,
 		PieceCount:      pieceCount,
 		PieceSize:       int(pieceSize),
@@ -266,7 +287,10 @@ func CreateResource(w http.ResponseWriter, r *http.Request) {
 		Tags:            tags,
 		DifficultyLevel: difficultyLevel,
 		CreatedAt:       time.Now(),
+		Deduplicated:    deduplicated,
+		ScanStatus:      ScanStatusPending,
 	}
+	requestScan()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resource)
@@ -283,10 +307,10 @@ func GetResources(w http.ResponseWriter, r *http.Request) {
 		SELECT r.id, r.title, r.description, r.skill_category, r.file_hash, r.file_size,
 			   r.mime_type, r.uploader_id, r.piece_count, r.piece_size, r.pieces_hash,
 			   r.tags, r.difficulty_level, r.rating, r.download_count, r.created_at,
-			   u.username, u.name
+			   u.username, u.name, r.scan_status
 		FROM resources r
 		JOIN users u ON r.uploader_id = u.id
-		WHERE 1=1`
+		WHERE r.removed_at IS NULL AND r.scan_status <> 'quarantined'`
 
 	args := []interface{}{}
 	argIndex := 1
@@ -341,7 +365,7 @@ func GetResources(w http.ResponseWriter, r *http.Request) {
 			&resource.FileHash, &resource.FileSize, &resource.MimeType, &resource.UploaderID,
 			&resource.PieceCount, &resource.PieceSize, &resource.PiecesHash, &tagsArray,
 			&resource.DifficultyLevel, &resource.Rating, &resource.DownloadCount,
-			&resource.CreatedAt, &resource.Username, &resource.Name,
+			&resource.CreatedAt, &resource.Username, &resource.Name, &resource.ScanStatus,
 		)
 		if err != nil {
 			continue
@@ -402,7 +426,7 @@ func GetResourceDetails(w http.ResponseWriter, r *http.Request) {
 			   u.username, u.name
 		FROM resources r
 		JOIN users u ON r.uploader_id = u.id
-		WHERE r.id = $1`, resourceID).Scan(
+		WHERE r.id = $1 AND r.removed_at IS NULL`, resourceID).Scan(
 		&resource.ID, &resource.Title, &resource.Description, &resource.SkillCategory,
 		&resource.FileHash, &resource.FileSize, &resource.MimeType, &resource.UploaderID,
 		&resource.PieceCount, &resource.PieceSize, &resource.PiecesHash, &tagsArray,
@@ -593,58 +617,81 @@ func GetPiece(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get resource info
-	var fileName, piecesHash string
-	var pieceSize int
-
-	err = db.DB.QueryRow(`
-		SELECT file_name, piece_size, pieces_hash 
-		FROM resources 
-		WHERE id = $1`, resourceID).Scan(&fileName, &pieceSize, &piecesHash)
-
-	if err != nil {
+	piece, _, err := readPiece(resourceID, pieceIndex)
+	if err == errPieceNotFound {
 		http.Error(w, "resource not found", http.StatusNotFound)
 		return
+	} else if err == errPieceHashMismatch {
+		http.Error(w, "piece hash mismatch", http.StatusNotFound)
+		return
+	} else if err == errQuarantined || err == errScanPending {
+		writeScanError(w, err)
+		return
+	} else if err != nil {
+		http.Error(w, "read error", http.StatusInternalServerError)
+		return
 	}
 
-	// Open the file
-	file, err := os.Open("./p2p_resources/" + fileName)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(piece)))
+	w.Write(piece)
+}
+
+var (
+	errPieceNotFound     = errors.New("piece not found")
+	errPieceHashMismatch = errors.New("piece hash mismatch")
+)
+
+// readPiece loads a single piece of a resource from disk and verifies it
+// against the stored piece hash. It returns the piece bytes and the byte
+// offset of the piece within the file.
+func readPiece(resourceID, pieceIndex int) ([]byte, int64, error) {
+	var storageKey, piecesHash, scanStatus string
+	var pieceSize int
+
+	err := db.DB.QueryRow(`
+		SELECT b.storage_key, r.piece_size, r.pieces_hash, r.scan_status
+		FROM resources r
+		JOIN resource_blobs b ON b.file_hash = r.file_hash
+		WHERE r.id = $1 AND r.removed_at IS NULL`, resourceID).Scan(&storageKey, &pieceSize, &piecesHash, &scanStatus)
 	if err != nil {
-		http.Error(w, "file not found", http.StatusNotFound)
-		return
+		return nil, 0, errPieceNotFound
+	}
+	if err := scanStatusError(scanStatus); err != nil {
+		return nil, 0, err
 	}
-	defer file.Close()
 
-	// Seek to piece position
+	pieceHashes := strings.Split(piecesHash, ",")
+	if pieceIndex < 0 || pieceIndex >= len(pieceHashes) {
+		return nil, 0, errPieceNotFound
+	}
+
+	// Fetch just this piece from blob storage
 	offset := int64(pieceIndex) * int64(pieceSize)
-	_, err = file.Seek(offset, 0)
-	if err != nil {
-		http.Error(w, "seek error", http.StatusInternalServerError)
-		return
+	file, err := storage.Blobs.Get(storageKey, offset, int64(pieceSize))
+	if err == storage.ErrNotFound {
+		return nil, 0, errPieceNotFound
+	} else if err != nil {
+		return nil, 0, err
 	}
+	defer file.Close()
 
-	// Read piece
+	// Read piece; the last piece may be shorter than pieceSize
 	piece := make([]byte, pieceSize)
-	n, err := file.Read(piece)
-	if err != nil && err != io.EOF {
-		http.Error(w, "read error", http.StatusInternalServerError)
-		return
+	n, err := io.ReadFull(file, piece)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, 0, err
 	}
+	piece = piece[:n]
 
 	// Verify piece hash
 	hasher := sha256.New()
-	hasher.Write(piece[:n])
-	pieceHash := hex.EncodeToString(hasher.Sum(nil))
-
-	pieceHashes := strings.Split(piecesHash, ",")
-	if pieceIndex >= len(pieceHashes) || pieceHashes[pieceIndex] != pieceHash {
-		http.Error(w, "piece hash mismatch", http.StatusNotFound)
-		return
+	hasher.Write(piece)
+	if pieceHashes[pieceIndex] != hex.EncodeToString(hasher.Sum(nil)) {
+		return nil, 0, errPieceHashMismatch
 	}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", strconv.Itoa(n))
-	w.Write(piece[:n])
+	return piece, offset, nil
 }
 
 // Helper functions
@@ -772,6 +819,11 @@ func CreateP2PRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if isBlocked(req.RequesterID, req.TargetUserID) {
+		http.Error(w, "Cannot request resources from this user", http.StatusForbidden)
+		return
+	}
+
 	// Check if there's already a pending request
 	var existingRequestID int
 	err := db.DB.QueryRow(`
@@ -75,6 +75,23 @@ func CreateP2PConnection(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if isBlocked(req.RequesterID, req.TargetUserID) {
+		http.Error(w, "Cannot request a connection from this user", http.StatusForbidden)
+		return
+	}
+
+	// Run the request note through the spam filters
+	decision := filterContent(FilterInput{
+		Kind:     FilterKindConnectionRequest,
+		SenderID: req.RequesterID,
+		TargetID: req.TargetUserID,
+		Content:  req.Message,
+	})
+	if decision.Verdict == VerdictReject {
+		http.Error(w, "Connection request rejected: "+decision.Reason, rejectionStatus(decision))
+		return
+	}
+
 	// Check if there's already a pending request
 	var existingRequestID int
 	err := db.DB.QueryRow(`
@@ -0,0 +1,323 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"main/db"
+	"sync"
+	"time"
+)
+
+// Presence states
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+	PresenceDND     = "dnd"
+)
+
+// Presence message types
+const (
+	MsgTypePresence  = "presence"
+	MsgTypeHeartbeat = "heartbeat"
+)
+
+const (
+	presenceIdleTimeout   = 5 * time.Minute
+	presenceSweepInterval = 30 * time.Second
+)
+
+// PresenceInfo is the payload of a presence event
+type PresenceInfo struct {
+	UserID   int    `json:"user_id"`
+	Status   string `json:"status"`
+	Online   bool   `json:"online"`
+	LastSeen string `json:"last_seen,omitempty"`
+}
+
+type presenceEntry struct {
+	status     string
+	manual     string // away/dnd chosen by the user; overrides idle detection
+	lastActive time.Time
+}
+
+// PresenceService tracks online/away/dnd state for connected users and
+// persists last-seen timestamps for everyone else
+type PresenceService struct {
+	entries map[int]*presenceEntry
+	mu      sync.Mutex
+
+	// transitions orders connected and disconnected, which the manager
+	// starts as goroutines that may run out of order on a quick reconnect
+	transitions sync.Mutex
+}
+
+var presence = &PresenceService{
+	entries: make(map[int]*presenceEntry),
+}
+
+// StartPresenceService starts idle detection for connected users
+func StartPresenceService() {
+	go presence.run()
+}
+
+func (p *PresenceService) run() {
+	ticker := time.NewTicker(presenceSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.sweepIdle()
+	}
+}
+
+// sweepIdle marks users away when no heartbeat arrived within the idle timeout
+func (p *PresenceService) sweepIdle() {
+	cutoff := time.Now().Add(-presenceIdleTimeout)
+
+	var idle []int
+	p.mu.Lock()
+	for userID, entry := range p.entries {
+		if entry.manual == "" && entry.status == PresenceOnline && entry.lastActive.Before(cutoff) {
+			entry.status = PresenceAway
+			idle = append(idle, userID)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, userID := range idle {
+		p.persist(userID, PresenceAway, "")
+		p.notify(userID, PresenceAway)
+	}
+}
+
+// connected is called when a user's socket registers. It does nothing if
+// the socket has already gone again.
+func (p *PresenceService) connected(userID int) {
+	p.transitions.Lock()
+	defer p.transitions.Unlock()
+	if !IsUserOnline(userID) {
+		return
+	}
+
+	var manual sql.NullString
+	err := db.DB.QueryRow(`SELECT manual_status FROM user_presence WHERE user_id = $1`, userID).Scan(&manual)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error loading presence for user %d: %v", userID, err)
+	}
+
+	status := PresenceOnline
+	if manual.Valid {
+		status = manual.String
+	}
+
+	p.mu.Lock()
+	p.entries[userID] = &presenceEntry{
+		status:     status,
+		manual:     manual.String,
+		lastActive: time.Now(),
+	}
+	p.mu.Unlock()
+
+	p.persist(userID, status, manual.String)
+	p.notify(userID, status)
+	p.sendSnapshot(userID)
+}
+
+// disconnected is called when a user's socket unregisters. It does nothing
+// if the user has reconnected in the meantime.
+func (p *PresenceService) disconnected(userID int) {
+	p.transitions.Lock()
+	defer p.transitions.Unlock()
+	if IsUserOnline(userID) {
+		return
+	}
+
+	p.mu.Lock()
+	var manual string
+	if entry, ok := p.entries[userID]; ok {
+		manual = entry.manual
+		delete(p.entries, userID)
+	}
+	p.mu.Unlock()
+
+	p.persist(userID, PresenceOffline, manual)
+	p.notify(userID, PresenceOffline)
+}
+
+// heartbeat records client activity; idle heartbeats mark the user away
+func (p *PresenceService) heartbeat(userID int, idle bool) {
+	p.mu.Lock()
+	entry, ok := p.entries[userID]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+
+	previous := entry.status
+	if idle {
+		if entry.manual == "" {
+			entry.status = PresenceAway
+		}
+	} else {
+		entry.lastActive = time.Now()
+		if entry.manual == "" {
+			entry.status = PresenceOnline
+		}
+	}
+	status := entry.status
+	p.mu.Unlock()
+
+	if status != previous {
+		p.persist(userID, status, "")
+		p.notify(userID, status)
+	}
+}
+
+// setStatus applies a status chosen by the user. Online clears any manual
+// away/dnd status and hands control back to idle detection.
+func (p *PresenceService) setStatus(userID int, status string) bool {
+	manual := ""
+	switch status {
+	case PresenceOnline:
+	case PresenceAway, PresenceDND:
+		manual = status
+	default:
+		return false
+	}
+
+	p.mu.Lock()
+	if entry, ok := p.entries[userID]; ok {
+		entry.status = status
+		entry.manual = manual
+		entry.lastActive = time.Now()
+	}
+	p.mu.Unlock()
+
+	p.persist(userID, status, manual)
+	p.notify(userID, status)
+	return true
+}
+
+// lookup returns the current presence of a user, falling back to the
+// persisted last-seen time for users who are not connected
+func (p *PresenceService) lookup(userID int) PresenceInfo {
+	p.mu.Lock()
+	entry, ok := p.entries[userID]
+	var status string
+	if ok {
+		status = entry.status
+	}
+	p.mu.Unlock()
+
+	if ok {
+		return PresenceInfo{UserID: userID, Status: status, Online: true}
+	}
+
+	info := PresenceInfo{UserID: userID, Status: PresenceOffline}
+	var lastSeen sql.NullTime
+	err := db.DB.QueryRow(`SELECT last_seen FROM user_presence WHERE user_id = $1`, userID).Scan(&lastSeen)
+	if err == nil && lastSeen.Valid {
+		info.LastSeen = lastSeen.Time.UTC().Format(time.RFC3339)
+	}
+	return info
+}
+
+func (p *PresenceService) persist(userID int, status, manual string) {
+	_, err := db.DB.Exec(`
+		INSERT INTO user_presence(user_id, status, manual_status, last_seen, updated_at)
+		VALUES($1, $2, NULLIF($3, ''), NOW(), NOW())
+		ON CONFLICT (user_id)
+		DO UPDATE SET
+			status = EXCLUDED.status,
+			manual_status = EXCLUDED.manual_status,
+			last_seen = NOW(),
+			updated_at = NOW()`,
+		userID, status, manual)
+	if err != nil {
+		log.Printf("Error persisting presence for user %d: %v", userID, err)
+	}
+}
+
+// notify delivers a presence event to connected users who share a chat or
+// P2P connection with userID
+func (p *PresenceService) notify(userID int, status string) {
+	info := PresenceInfo{UserID: userID, Status: status, Online: status != PresenceOffline}
+	if !info.Online {
+		info.LastSeen = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	message := UnifiedMessage{
+		Type:      MsgTypePresence,
+		UserID:    userID,
+		Status:    status,
+		Data:      info,
+		Timestamp: time.Now(),
+	}
+	for _, otherID := range presenceAudience(userID) {
+		if IsUserOnline(otherID) {
+			unifiedManager.sendToUser(otherID, message)
+		}
+	}
+}
+
+// sendSnapshot tells a newly connected user the presence of everyone they
+// are subscribed to
+func (p *PresenceService) sendSnapshot(userID int) {
+	for _, otherID := range presenceAudience(userID) {
+		info := p.lookup(otherID)
+		unifiedManager.sendToUser(userID, UnifiedMessage{
+			Type:      MsgTypePresence,
+			UserID:    otherID,
+			Status:    info.Status,
+			Data:      info,
+			Timestamp: time.Now(),
+		})
+	}
+}
+
+// presenceAudience returns the users who have a chat or connection
+// relationship with userID, leaving out anyone blocked in either direction
+func presenceAudience(userID int) []int {
+	rows, err := db.DB.Query(`
+		SELECT a.other_id FROM (
+			SELECT CASE WHEN sender_id = $1 THEN receiver_id ELSE sender_id END AS other_id
+			FROM messages
+			WHERE sender_id = $1 OR receiver_id = $1
+			UNION
+			SELECT CASE WHEN requester_id = $1 THEN target_user_id ELSE requester_id END
+			FROM p2p_connections
+			WHERE (requester_id = $1 OR target_user_id = $1) AND status IN ('pending', 'approved')
+		) a
+		WHERE NOT EXISTS (
+			SELECT 1 FROM user_blocks b
+			WHERE (b.blocker_id = $1 AND b.blocked_id = a.other_id) OR (b.blocker_id = a.other_id AND b.blocked_id = $1)
+		)
+	`, userID)
+	if err != nil {
+		log.Printf("Error loading presence audience for user %d: %v", userID, err)
+		return nil
+	}
+	defer rows.Close()
+
+	var audience []int
+	for rows.Next() {
+		var otherID int
+		if err := rows.Scan(&otherID); err != nil {
+			continue
+		}
+		if otherID != userID {
+			audience = append(audience, otherID)
+		}
+	}
+	return audience
+}
+
+func (c *UnifiedClient) handlePresence(message UnifiedMessage) {
+	if !presence.setStatus(c.userID, message.Status) {
+		c.sendError(ErrCodeInvalidMessage, "status must be online, away or dnd", message.Type)
+	}
+}
+
+func (c *UnifiedClient) handleHeartbeat(message UnifiedMessage) {
+	presence.heartbeat(c.userID, message.Idle)
+}
@@ -8,9 +8,8 @@ import (
 	"log"
 	"main/db"
 	"main/models"
+	"main/storage"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -97,6 +96,9 @@ func GetProfile(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if variants := profileVariantURLs(id); len(variants) > 0 {
+		user.ProfilePhotoVariants = variants
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -216,10 +218,19 @@ func UploadProfilePhoto(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Validate file type (only images)
-	contentType := header.Header.Get("Content-Type")
-	if !isValidImageType(contentType) {
-		http.Error(w, "Invalid file type. Only JPEG, PNG, and GIF are allowed", http.StatusBadRequest)
+	// Validate file type by its content (only images)
+	head, err := readHead(file)
+	if err != nil {
+		http.Error(w, "Failed to read file", http.StatusBadRequest)
+		return
+	}
+	contentType, err := checkFileType(UploadKindProfilePhoto, header.Filename, head)
+	if err != nil {
+		writeFileTypeError(w, err)
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
 		return
 	}
 
@@ -228,50 +239,130 @@ func UploadProfilePhoto(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "File too large. Maximum size is 5MB", http.StatusBadRequest)
 		return
 	}
+	data, err := io.ReadAll(io.LimitReader(file, 5*1024*1024+1))
+	if err != nil {
+		http.Error(w, "Failed to read file", http.StatusBadRequest)
+		return
+	}
 
-	// Generate unique filename
-	ext := getFileExtension(header.Filename)
-	filename := fmt.Sprintf("profile_%d_%d%s", userID, time.Now().Unix(), ext)
-
-	// Save file to uploads directory
-	uploadsDir := "./uploads/profiles"
-	os.MkdirAll(uploadsDir, 0755)
-
-	filePath := filepath.Join(uploadsDir, filename)
-	dst, err := os.Create(filePath)
+	// Re-encode upright without metadata, plus the avatar sizes
+	images, err := renderProfilePhoto(data)
 	if err != nil {
-		log.Printf("Error creating file: %v", err)
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		http.Error(w, "Could not read "+contentType+" image: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer dst.Close()
+	var totalSize int64
+	for _, img := range images {
+		totalSize += int64(len(img.data))
+	}
 
-	_, err = io.Copy(dst, file)
+	// The new photo replaces the old one, so only the difference counts
+	usage, err := storageUsage(userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := usage.allows(totalSize - usage.ProfilePhotoBytes); err != nil {
+		writeQuotaError(w, err)
+		return
+	}
+	var oldPhoto string
+	db.DB.QueryRow(`SELECT COALESCE(profile_photo, '') FROM users WHERE id = $1`, userID).Scan(&oldPhoto)
+
+	// Save every variant to blob storage under a unique base name
+	base := fmt.Sprintf("profile_%d_%d", userID, time.Now().UnixNano())
+	keys, err := putRendered(images, func(img renderedImage) string {
+		if img.variant == VariantOriginal {
+			return storage.PrefixProfiles + base + img.ext
+		}
+		return storage.PrefixProfiles + base + "_" + img.variant + img.ext
+	})
 	if err != nil {
 		log.Printf("Error saving file: %v", err)
 		http.Error(w, "Failed to save file", http.StatusInternalServerError)
 		return
 	}
 
-	// Update user's profile_photo in database
-	photoURL := fmt.Sprintf("/uploads/profiles/%s", filename)
-	_, err = db.DB.Exec("UPDATE users SET profile_photo = $1 WHERE id = $2", photoURL, userID)
+	// Update user's profile_photo and swap the variants in one go
+	photoURL := "/" + keys[0]
+	oldKeys, err := replaceProfilePhoto(userID, photoURL, totalSize, images, keys)
 	if err != nil {
+		deleteBlobs(keys)
 		log.Printf("Error updating profile photo in database: %v", err)
 		http.Error(w, "Failed to update profile", http.StatusInternalServerError)
 		return
 	}
 
+	// Drop the replaced photo and its variants so they stop taking space,
+	// unless a concurrent upload happened to reuse a key
+	if oldKey := strings.TrimPrefix(oldPhoto, "/"); oldKey != oldPhoto && strings.HasPrefix(oldKey, storage.PrefixProfiles) {
+		oldKeys = append(oldKeys, oldKey)
+	}
+	current := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		current[key] = true
+	}
+	for _, key := range oldKeys {
+		if current[key] {
+			continue
+		}
+		if err := storage.Blobs.Delete(key); err != nil {
+			log.Printf("Error deleting old profile photo %s: %v", key, err)
+		}
+	}
+
 	// Return success response with photo URL
 	w.Header().Set("Content-Type", "application/json")
-	response := map[string]string{
+	response := map[string]interface{}{
 		"status":    "success",
 		"message":   "Profile photo updated successfully",
 		"photo_url": photoURL,
+		"variants":  profileVariantURLs(userID),
 	}
 	json.NewEncoder(w).Encode(response)
 }
 
+// replaceProfilePhoto points userID at a new photo and records its
+// variants, returning the storage keys of the variants it replaced
+func replaceProfilePhoto(userID int, photoURL string, size int64, images []renderedImage, keys []string) ([]string, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET profile_photo = $1, profile_photo_size = $2 WHERE id = $3", photoURL, size, userID); err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`DELETE FROM image_variants WHERE user_id = $1 RETURNING storage_key`, userID)
+	if err != nil {
+		return nil, err
+	}
+	var oldKeys []string
+	for rows.Next() {
+		var key string
+		if rows.Scan(&key) == nil {
+			oldKeys = append(oldKeys, key)
+		}
+	}
+	rows.Close()
+
+	for i, img := range images {
+		_, err := tx.Exec(`
+			INSERT INTO image_variants(user_id, variant, storage_key, content_type, width, height, size)
+			VALUES($1, $2, $3, $4, $5, $6, $7)
+		`, userID, img.variant, keys[i], img.contentType, img.width, img.height, len(img.data))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return oldKeys, tx.Commit()
+}
+
 // Helper function to get user's skills with resources
 func GetUserSkillsWithResources(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -421,28 +512,3 @@ func GetUserSkillsWithResources(w http.ResponseWriter, r *http.Request) {
 	}
 	json.NewEncoder(w).Encode(response)
 }
-
-func isValidImageType(contentType string) bool {
-	validTypes := []string{
-		"image/jpeg",
-		"image/jpg",
-		"image/png",
-		"image/gif",
-		"image/webp",
-	}
-
-	for _, validType := range validTypes {
-		if contentType == validType {
-			return true
-		}
-	}
-	return false
-}
-
-func getFileExtension(filename string) string {
-	ext := filepath.Ext(filename)
-	if ext == "" {
-		return ".jpg" // default extension
-	}
-	return ext
-}
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"main/db"
+	"net/http"
+	"strconv"
+)
+
+// Storage quotas
+//
+// Every user has a byte quota covering chat attachments, resources, their
+// profile photo and resumable uploads still in progress (reserved at their
+// declared size). The quota comes from users.storage_quota when an admin has
+// set an override, otherwise from role_storage_quotas. -1 means unlimited.
+//
+// Resources are charged at their full size even when their content is
+// shared with another upload, so deleting someone else's copy never pushes
+// a user over quota.
+
+// unlimitedQuota is the quota_bytes value for no limit
+const unlimitedQuota = -1
+
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// StorageUsage is a user's quota and what counts against it
+type StorageUsage struct {
+	UserID            int    `json:"user_id"`
+	QuotaBytes        int64  `json:"quota_bytes"`
+	QuotaSource       string `json:"quota_source"` // "user" override or "role" default
+	UsedBytes         int64  `json:"used_bytes"`
+	AttachmentBytes   int64  `json:"attachment_bytes"`
+	ResourceBytes     int64  `json:"resource_bytes"`
+	ProfilePhotoBytes int64  `json:"profile_photo_bytes"`
+	PendingBytes      int64  `json:"pending_upload_bytes"`
+	AvailableBytes    int64  `json:"available_bytes"` // -1 when unlimited
+}
+
+// storageUsage totals everything stored by userID
+func storageUsage(userID int) (*StorageUsage, error) {
+	u := &StorageUsage{UserID: userID, QuotaSource: "role"}
+	var override bool
+	err := db.DB.QueryRow(`
+		SELECT
+			(SELECT COALESCE(SUM(size), 0) FROM files WHERE uploader_id = u.id),
+			(SELECT COALESCE(SUM(file_size), 0) FROM resources WHERE uploader_id = u.id),
+			u.profile_photo_size,
+			(SELECT COALESCE(SUM(size), 0) FROM upload_sessions
+			 WHERE user_id = u.id AND completed_at IS NULL AND expires_at > NOW()),
+			COALESCE(u.storage_quota, q.quota_bytes, $2),
+			u.storage_quota IS NOT NULL
+		FROM users u
+		LEFT JOIN role_storage_quotas q ON q.role = u.role
+		WHERE u.id = $1
+	`, userID, unlimitedQuota).Scan(&u.AttachmentBytes, &u.ResourceBytes, &u.ProfilePhotoBytes, &u.PendingBytes,
+		&u.QuotaBytes, &override)
+	if err != nil {
+		return nil, err
+	}
+	if override {
+		u.QuotaSource = "user"
+	}
+
+	u.UsedBytes = u.AttachmentBytes + u.ResourceBytes + u.ProfilePhotoBytes + u.PendingBytes
+	u.AvailableBytes = unlimitedQuota
+	if u.QuotaBytes != unlimitedQuota {
+		u.AvailableBytes = max(u.QuotaBytes-u.UsedBytes, 0)
+	}
+	return u, nil
+}
+
+// allows reports errQuotaExceeded if size more bytes would not fit
+func (u *StorageUsage) allows(size int64) error {
+	if u.QuotaBytes == unlimitedQuota || u.UsedBytes+size <= u.QuotaBytes {
+		return nil
+	}
+	return fmt.Errorf("%w: %d of %d bytes used, this upload needs %d", errQuotaExceeded, u.UsedBytes, u.QuotaBytes, size)
+}
+
+// checkQuota reports errQuotaExceeded if userID cannot store size more bytes
+func checkQuota(userID int, size int64) error {
+	u, err := storageUsage(userID)
+	if err != nil {
+		return err
+	}
+	return u.allows(size)
+}
+
+// writeQuotaError answers a failed checkQuota
+func writeQuotaError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errQuotaExceeded) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+}
+
+// GET /api/storage/usage?user_id=1
+func GetStorageUsage(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		http.Error(w, "user_id parameter required", http.StatusBadRequest)
+		return
+	}
+	usage, err := storageUsage(userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+// GET /api/admin/quotas?admin_id=1[&user_id=5]
+// Without user_id, lists the role defaults and every per-user override;
+// with it, returns that user's usage.
+func GetQuotas(w http.ResponseWriter, r *http.Request) {
+	adminID, _ := strconv.Atoi(r.URL.Query().Get("admin_id"))
+	if !isAdmin(adminID) {
+		http.Error(w, "admin role required", http.StatusForbidden)
+		return
+	}
+
+	if userIDStr := r.URL.Query().Get("user_id"); userIDStr != "" {
+		userID, _ := strconv.Atoi(userIDStr)
+		usage, err := storageUsage(userID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "user not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(usage)
+		return
+	}
+
+	roles := make(map[string]int64)
+	rows, err := db.DB.Query(`SELECT role, quota_bytes FROM role_storage_quotas`)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var role string
+		var quota int64
+		if rows.Scan(&role, &quota) == nil {
+			roles[role] = quota
+		}
+	}
+	rows.Close()
+
+	type override struct {
+		UserID     int    `json:"user_id"`
+		Username   string `json:"username"`
+		Role       string `json:"role"`
+		QuotaBytes int64  `json:"quota_bytes"`
+	}
+	overrides := []override{}
+	rows, err = db.DB.Query(`SELECT id, username, role, storage_quota FROM users WHERE storage_quota IS NOT NULL ORDER BY username`)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var o override
+		if rows.Scan(&o.UserID, &o.Username, &o.Role, &o.QuotaBytes) == nil {
+			overrides = append(overrides, o)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"roles":     roles,
+		"overrides": overrides,
+	})
+}
+
+// POST /api/admin/quotas  {admin_id, user_id | role, quota_bytes}
+// quota_bytes -1 is unlimited. For a user, a null quota_bytes removes the
+// override so the role default applies again. Lowering a quota never
+// deletes anything; it only blocks new uploads.
+func SetQuota(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		AdminID    int    `json:"admin_id"`
+		UserID     int    `json:"user_id"`
+		Role       string `json:"role"`
+		QuotaBytes *int64 `json:"quota_bytes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !isAdmin(req.AdminID) {
+		http.Error(w, "admin role required", http.StatusForbidden)
+		return
+	}
+	if req.QuotaBytes != nil && *req.QuotaBytes < unlimitedQuota {
+		http.Error(w, "quota_bytes must be -1 (unlimited) or at least 0", http.StatusBadRequest)
+		return
+	}
+
+	var res sql.Result
+	var err error
+	switch {
+	case req.UserID != 0 && req.Role == "":
+		res, err = db.DB.Exec(`UPDATE users SET storage_quota = $1 WHERE id = $2`, req.QuotaBytes, req.UserID)
+	case req.Role != "" && req.UserID == 0:
+		if req.QuotaBytes == nil {
+			http.Error(w, "quota_bytes required for a role", http.StatusBadRequest)
+			return
+		}
+		res, err = db.DB.Exec(`UPDATE role_storage_quotas SET quota_bytes = $1, updated_at = NOW() WHERE role = $2`,
+			*req.QuotaBytes, req.Role)
+	default:
+		http.Error(w, "exactly one of user_id or role required", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "user or role not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      "success",
+		"user_id":     req.UserID,
+		"role":        req.Role,
+		"quota_bytes": req.QuotaBytes,
+	})
+}
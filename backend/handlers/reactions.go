@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"main/db"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// Reaction message types. Clients send reaction_add and reaction_remove; the
+// server answers both participants with a reaction event.
+const (
+	MsgTypeReactionAdd    = "reaction_add"
+	MsgTypeReactionRemove = "reaction_remove"
+	MsgTypeReaction       = "reaction"
+)
+
+const maxEmojiLength = 32
+
+var errInvalidEmoji = errors.New("emoji must be a short non-empty string")
+
+// ReactionCount is the aggregated count for one emoji on a message
+type ReactionCount struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	Reacted bool   `json:"reacted"` // whether the viewer used this emoji
+}
+
+// ReactionEvent is the payload of a reaction event
+type ReactionEvent struct {
+	MessageID int             `json:"message_id"`
+	UserID    int             `json:"user_id"`
+	Emoji     string          `json:"emoji"`
+	Action    string          `json:"action"` // added or removed
+	Reactions []ReactionCount `json:"reactions"`
+}
+
+// setReaction adds or removes one emoji reaction and notifies both
+// participants of the new totals
+func setReaction(userID, messageID int, emoji string, add bool) (*ReactionEvent, error) {
+	emoji = strings.TrimSpace(emoji)
+	if emoji == "" || len(emoji) > maxEmojiLength || !utf8.ValidString(emoji) || strings.ContainsAny(emoji, " \t\n") {
+		return nil, errInvalidEmoji
+	}
+
+	var senderID, receiverID int
+	var deletedAt, removedAt sql.NullTime
+	var released bool
+	err := db.DB.QueryRow(`SELECT sender_id, receiver_id, deleted_at, removed_at, released FROM messages WHERE id = $1`, messageID).
+		Scan(&senderID, &receiverID, &deletedAt, &removedAt, &released)
+	if err == sql.ErrNoRows {
+		return nil, errMessageNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if userID != senderID && userID != receiverID {
+		return nil, errNotParticipant
+	}
+	// A scheduled message does not exist for the receiver yet, and reacting
+	// to it would tell them it does
+	if !released {
+		if userID == receiverID {
+			return nil, errMessageNotFound
+		}
+		return nil, errMessageNotSent
+	}
+	if deletedAt.Valid {
+		return nil, errMessageDeleted
+	}
+	if removedAt.Valid {
+		return nil, errMessageRemoved
+	}
+
+	event := &ReactionEvent{MessageID: messageID, UserID: userID, Emoji: emoji}
+	if add {
+		event.Action = "added"
+		_, err = db.DB.Exec(`
+			INSERT INTO message_reactions(message_id, user_id, emoji) VALUES($1, $2, $3)
+			ON CONFLICT (message_id, user_id, emoji) DO NOTHING
+		`, messageID, userID, emoji)
+	} else {
+		event.Action = "removed"
+		_, err = db.DB.Exec(`DELETE FROM message_reactions WHERE message_id = $1 AND user_id = $2 AND emoji = $3`,
+			messageID, userID, emoji)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Counts are the same for both sides; reacted is per viewer
+	for _, recipient := range []int{senderID, receiverID} {
+		counts, err := loadReactions([]int{messageID}, recipient)
+		if err != nil {
+			return nil, err
+		}
+		payload := *event
+		payload.Reactions = counts[messageID]
+		if payload.Reactions == nil {
+			payload.Reactions = []ReactionCount{}
+		}
+		if recipient == userID {
+			event.Reactions = payload.Reactions
+		}
+		unifiedManager.sendToUser(recipient, UnifiedMessage{
+			Type:       MsgTypeReaction,
+			UserID:     userID,
+			ReceiverID: receiverID,
+			MessageID:  messageID,
+			Emoji:      emoji,
+			Data:       payload,
+			Timestamp:  time.Now(),
+		})
+	}
+	return event, nil
+}
+
+// loadReactions aggregates reactions for a set of messages as seen by viewerID
+func loadReactions(messageIDs []int, viewerID int) (map[int][]ReactionCount, error) {
+	out := make(map[int][]ReactionCount)
+	if len(messageIDs) == 0 {
+		return out, nil
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT message_id, emoji, COUNT(*), BOOL_OR(user_id = $2)
+		FROM message_reactions
+		WHERE message_id = ANY($1)
+		GROUP BY message_id, emoji
+		ORDER BY message_id, MIN(created_at)
+	`, pq.Array(messageIDs), viewerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID int
+		var rc ReactionCount
+		if err := rows.Scan(&messageID, &rc.Emoji, &rc.Count, &rc.Reacted); err != nil {
+			continue
+		}
+		out[messageID] = append(out[messageID], rc)
+	}
+	return out, rows.Err()
+}
+
+func (c *UnifiedClient) handleReaction(message UnifiedMessage) {
+	_, err := setReaction(c.userID, message.MessageID, message.Emoji, message.Type == MsgTypeReactionAdd)
+	if err != nil {
+		code, _ := messageActionStatus(err)
+		c.sendError(code, err.Error(), message.Type)
+	}
+}
+
+// POST /api/messages/reactions  {user_id, message_id, emoji, action: "add"|"remove"}
+func ReactToMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		UserID    int    `json:"user_id"`
+		MessageID int    `json:"message_id"`
+		Emoji     string `json:"emoji"`
+		Action    string `json:"action"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Action != "add" && req.Action != "remove" {
+		http.Error(w, "action must be add or remove", http.StatusBadRequest)
+		return
+	}
+
+	event, err := setReaction(req.UserID, req.MessageID, req.Emoji, req.Action == "add")
+	if err != nil {
+		_, status := messageActionStatus(err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(event)
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"main/db"
+	"net/http"
+	"time"
+)
+
+// Typing and read receipt message types
+const (
+	MsgTypeTyping = "typing"
+	MsgTypeRead   = "read"
+)
+
+// Typing states carried in UnifiedMessage.Status
+const (
+	TypingStart = "start"
+	TypingStop  = "stop"
+)
+
+// ReadReceipt is the payload of a read event
+type ReadReceipt struct {
+	ReaderID   int    `json:"reader_id"`
+	PartnerID  int    `json:"partner_id"`
+	MessageID  int    `json:"message_id"`
+	MessageIDs []int  `json:"message_ids"`
+	ReadAt     string `json:"read_at"`
+}
+
+// handleTyping forwards an ephemeral typing event to the conversation partner
+func (c *UnifiedClient) handleTyping(message UnifiedMessage) {
+	if message.ReceiverID == 0 || message.ReceiverID == c.userID {
+		c.sendError(ErrCodeInvalidMessage, "receiver_id required", message.Type)
+		return
+	}
+	if message.Status != TypingStart && message.Status != TypingStop {
+		c.sendError(ErrCodeInvalidMessage, "status must be start or stop", message.Type)
+		return
+	}
+	if isBlocked(c.userID, message.ReceiverID) {
+		return
+	}
+
+	unifiedManager.sendToUserWithCapability(message.ReceiverID, CapTyping, UnifiedMessage{
+		Type:       MsgTypeTyping,
+		UserID:     c.userID,
+		ReceiverID: message.ReceiverID,
+		Status:     message.Status,
+		Timestamp:  time.Now(),
+	})
+}
+
+// handleRead marks the partner's messages as read up to message_id and
+// notifies the partner
+func (c *UnifiedClient) handleRead(message UnifiedMessage) {
+	if message.ReceiverID == 0 {
+		c.sendError(ErrCodeInvalidMessage, "receiver_id required", message.Type)
+		return
+	}
+
+	if _, err := markConversationRead(c.userID, message.ReceiverID, message.MessageID); err != nil {
+		log.Printf("Error marking messages read for user %d: %v", c.userID, err)
+	}
+}
+
+// markConversationRead marks every unread message from partnerID to readerID
+// with id <= upToID (or all of them when upToID is 0) as read, then sends a
+// read event to the partner
+func markConversationRead(readerID, partnerID, upToID int) (*ReadReceipt, error) {
+	rows, err := db.DB.Query(`
+		UPDATE messages
+		SET read_at = NOW(), delivered = true
+		WHERE sender_id = $1 AND receiver_id = $2 AND read_at IS NULL AND released
+		AND ($3 = 0 OR id <= $3)
+		RETURNING id, read_at
+	`, partnerID, readerID, upToID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	receipt := &ReadReceipt{
+		ReaderID:   readerID,
+		PartnerID:  partnerID,
+		MessageIDs: []int{},
+	}
+	var readAt time.Time
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id, &readAt); err != nil {
+			continue
+		}
+		receipt.MessageIDs = append(receipt.MessageIDs, id)
+		if id > receipt.MessageID {
+			receipt.MessageID = id
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	highWater := receipt.MessageID
+	if upToID > highWater {
+		highWater = upToID
+	}
+	if highWater > 0 {
+		advanceLastRead(readerID, partnerID, highWater)
+	}
+
+	if len(receipt.MessageIDs) == 0 {
+		return receipt, nil
+	}
+	receipt.ReadAt = readAt.UTC().Format(time.RFC3339)
+
+	unifiedManager.sendToUserWithCapability(partnerID, CapReceipts, UnifiedMessage{
+		Type:       MsgTypeRead,
+		UserID:     readerID,
+		ReceiverID: partnerID,
+		MessageID:  receipt.MessageID,
+		Data:       receipt,
+		Timestamp:  time.Now(),
+	})
+	return receipt, nil
+}
+
+// POST /api/messages/read  {user_id, partner_id, message_id}
+func MarkMessagesRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		UserID    int `json:"user_id"`
+		PartnerID int `json:"partner_id"`
+		MessageID int `json:"message_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == 0 || req.PartnerID == 0 {
+		http.Error(w, "user_id and partner_id are required", http.StatusBadRequest)
+		return
+	}
+
+	receipt, err := markConversationRead(req.UserID, req.PartnerID, req.MessageID)
+	if err != nil {
+		http.Error(w, "Database error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipt)
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"main/db"
+	"main/storage"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resource files are stored once per SHA-256 and shared by every resource
+// with the same content. resource_blobs.ref_count tracks how many resources
+// point at a blob; when it drops to zero the blob is marked orphaned and the
+// collector deletes it after blobGracePeriod.
+const (
+	blobCollectInterval = time.Hour
+	blobGracePeriod     = time.Hour
+)
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// contentKey is where new resource content is stored
+func contentKey(fileHash string) string {
+	return storage.PrefixResources + "sha256/" + fileHash[:2] + "/" + fileHash
+}
+
+// resourceStorageKey finds the blob behind a resource
+func resourceStorageKey(resourceID int) (string, error) {
+	var key string
+	err := db.DB.QueryRow(`
+		SELECT b.storage_key FROM resources r
+		JOIN resource_blobs b ON b.file_hash = r.file_hash
+		WHERE r.id = $1
+	`, resourceID).Scan(&key)
+	return key, err
+}
+
+// acquireResourceBlob takes a reference on the blob for fileHash, moving the
+// spooled file at path into storage only when no live copy exists. It
+// reports whether the upload was skipped because the content was already
+// stored; the caller still owns path in that case.
+func acquireResourceBlob(fileHash string, size int64, contentType, path string) (deduplicated bool, err error) {
+	var refs sql.NullInt64
+	err = db.DB.QueryRow(`SELECT ref_count FROM resource_blobs WHERE file_hash = $1`, fileHash).Scan(&refs)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	live := refs.Valid && refs.Int64 > 0
+	// An unreferenced row may be collected at any moment, along with
+	// whatever is stored under its key, including the copy stored below
+	collectable := refs.Valid && refs.Int64 == 0
+
+	uploaded := false
+	upload := func() error {
+		uploaded = true
+		return storage.PutFile(storage.Blobs, contentKey(fileHash), path, size, contentType)
+	}
+	if !live {
+		if err := upload(); err != nil {
+			return false, err
+		}
+	}
+
+	// The upsert waits on the collector's row lock, so a blob is never
+	// deleted after this reference is taken. Bytes stored before it are
+	// only safe if the row survived.
+	var inserted bool
+	err = db.DB.QueryRow(`
+		INSERT INTO resource_blobs(file_hash, storage_key, size, ref_count)
+		VALUES($1, $2, $3, 1)
+		ON CONFLICT (file_hash) DO UPDATE SET ref_count = resource_blobs.ref_count + 1, orphaned_at = NULL
+		RETURNING xmax = 0
+	`, fileHash, contentKey(fileHash), size).Scan(&inserted)
+	if err != nil {
+		return false, err
+	}
+
+	// The row we saw was collected in the meantime, and with it either the
+	// live copy or the one just stored; store it again
+	if inserted && (collectable || !uploaded) {
+		if err := upload(); err != nil {
+			releaseResourceBlob(db.DB, fileHash)
+			return false, err
+		}
+	}
+	return !uploaded, nil
+}
+
+// releaseResourceBlob drops one reference; the blob is orphaned at zero
+func releaseResourceBlob(ex execer, fileHash string) error {
+	_, err := ex.Exec(`
+		UPDATE resource_blobs
+		SET ref_count = GREATEST(ref_count - 1, 0),
+		    orphaned_at = CASE WHEN ref_count <= 1 THEN NOW() END
+		WHERE file_hash = $1
+	`, fileHash)
+	return err
+}
+
+// StartBlobCollector periodically deletes orphaned resource blobs
+func StartBlobCollector() {
+	go func() {
+		ticker := time.NewTicker(blobCollectInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			collectOrphanedBlobs()
+		}
+	}()
+}
+
+// collectOrphanedBlobs deletes blobs that have had no references for the
+// grace period. Each blob is deleted while its row is locked so a concurrent
+// upload of the same content either revives it first or re-uploads after.
+func collectOrphanedBlobs() {
+	rows, err := db.DB.Query(`
+		SELECT file_hash FROM resource_blobs
+		WHERE ref_count = 0 AND orphaned_at < NOW() - make_interval(secs => $1)
+	`, blobGracePeriod.Seconds())
+	if err != nil {
+		log.Printf("Error listing orphaned blobs: %v", err)
+		return
+	}
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if rows.Scan(&hash) == nil {
+			hashes = append(hashes, hash)
+		}
+	}
+	rows.Close()
+
+	collected := 0
+	for _, hash := range hashes {
+		if err := collectBlob(hash); err != nil {
+			log.Printf("Error collecting blob %s: %v", hash, err)
+			continue
+		}
+		collected++
+	}
+	if collected > 0 {
+		log.Printf("Collected %d orphaned resource blobs", collected)
+	}
+}
+
+func collectBlob(fileHash string) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Re-check under the lock, and never trust the count over the resources table
+	var key string
+	err = tx.QueryRow(`
+		SELECT storage_key FROM resource_blobs
+		WHERE file_hash = $1 AND ref_count = 0
+		AND NOT EXISTS (SELECT 1 FROM resources WHERE file_hash = $1)
+		FOR UPDATE
+	`, fileHash).Scan(&key)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Blobs backfilled from before content addressing can be shared by
+	// several hashes, since same-named uploads overwrote each other
+	var shared bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM resource_blobs WHERE storage_key = $1 AND file_hash <> $2)
+	`, key, fileHash).Scan(&shared)
+	if err != nil {
+		return err
+	}
+	if !shared {
+		if err := storage.Blobs.Delete(key); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM resource_blobs WHERE file_hash = $1`, fileHash); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DELETE /api/p2p/resource/{id}?user_id=1
+// The uploader or a moderator may delete a resource. Its file is kept while
+// other resources share the same content.
+func DeleteResource(w http.ResponseWriter, r *http.Request) {
+	resourceID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/p2p/resource/"))
+	if err != nil {
+		http.Error(w, "invalid resource id", http.StatusBadRequest)
+		return
+	}
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		http.Error(w, "user_id parameter required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var uploaderID int
+	var fileHash sql.NullString
+	err = tx.QueryRow(`SELECT COALESCE(uploader_id, 0), file_hash FROM resources WHERE id = $1 FOR UPDATE`, resourceID).
+		Scan(&uploaderID, &fileHash)
+	if err == sql.ErrNoRows {
+		http.Error(w, "resource not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if uploaderID != userID && !isModerator(userID) {
+		http.Error(w, "only the uploader can delete this resource", http.StatusForbidden)
+		return
+	}
+
+	// Swarms, torrents, participation and skill links cascade
+	if _, err := tx.Exec(`DELETE FROM resources WHERE id = $1`, resourceID); err != nil {
+		http.Error(w, "Failed to delete resource: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if fileHash.Valid {
+		if err := releaseResourceBlob(tx, fileHash.String); err != nil {
+			http.Error(w, "Failed to release file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      "success",
+		"resource_id": resourceID,
+	})
+}
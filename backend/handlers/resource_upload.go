@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+)
+
+const (
+	resourcePieceSize   = 1 << 20   // 1MB pieces
+	maxResourceSize     = 500 << 20 // 500MB
+	maxResourceFormSize = 64 << 10  // all non-file fields together
+)
+
+var (
+	errResourceTooLarge = errors.New("file too large")
+	errFormTooLarge     = errors.New("form fields too large")
+)
+
+// pieceHasher computes the whole-file hash and the per-piece hashes of a
+// stream as it is written, so piece boundaries never depend on how the
+// stream happens to be chunked
+type pieceHasher struct {
+	pieceSize int64
+	file      hash.Hash
+	piece     hash.Hash
+	inPiece   int64
+	pieces    []string
+	size      int64
+}
+
+func newPieceHasher(pieceSize int64) *pieceHasher {
+	return &pieceHasher{pieceSize: pieceSize, file: sha256.New(), piece: sha256.New()}
+}
+
+func (h *pieceHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	h.file.Write(p)
+	h.size += int64(n)
+	for len(p) > 0 {
+		chunk := p
+		if room := h.pieceSize - h.inPiece; int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		h.piece.Write(chunk)
+		h.inPiece += int64(len(chunk))
+		p = p[len(chunk):]
+		if h.inPiece == h.pieceSize {
+			h.endPiece()
+		}
+	}
+	return n, nil
+}
+
+func (h *pieceHasher) endPiece() {
+	h.pieces = append(h.pieces, hex.EncodeToString(h.piece.Sum(nil)))
+	h.piece.Reset()
+	h.inPiece = 0
+}
+
+// finish closes the last, possibly short, piece
+func (h *pieceHasher) finish() (fileHash string, pieceHashes []string) {
+	if h.inPiece > 0 {
+		h.endPiece()
+	}
+	return hex.EncodeToString(h.file.Sum(nil)), h.pieces
+}
+
+// resourceUpload is a resource upload spooled to a temp file
+type resourceUpload struct {
+	fields      map[string]string
+	fileName    string
+	tmpPath     string
+	size        int64
+	fileHash    string
+	pieceHashes []string
+	head        []byte // for sniffing the content type
+}
+
+// discard removes the temp file if it was not moved into storage
+func (u *resourceUpload) discard() {
+	if u.tmpPath != "" {
+		os.Remove(u.tmpPath)
+	}
+}
+
+// readResourceUpload streams a multipart resource upload. The "file" part is
+// written to a temp file while it is hashed, so memory use stays bounded no
+// matter how large the file is; every other part is a small form field.
+// beforeFile, if set, sees the fields sent ahead of the file and can refuse
+// the upload before any of it is read.
+func readResourceUpload(r *http.Request, beforeFile func(fields map[string]string) error) (*resourceUpload, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	u := &resourceUpload{fields: make(map[string]string)}
+	formBytes := int64(0)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			u.discard()
+			return nil, err
+		}
+
+		if part.FormName() == "file" && part.FileName() != "" {
+			if u.tmpPath != "" {
+				part.Close()
+				u.discard()
+				return nil, errors.New("only one file per resource")
+			}
+			if beforeFile != nil {
+				if err := beforeFile(u.fields); err != nil {
+					part.Close()
+					return nil, err
+				}
+			}
+			// FileName already drops any client-supplied directory
+			u.fileName = part.FileName()
+			if err := u.spool(part); err != nil {
+				part.Close()
+				u.discard()
+				return nil, err
+			}
+		} else {
+			value, err := io.ReadAll(io.LimitReader(part, maxResourceFormSize-formBytes+1))
+			formBytes += int64(len(value))
+			if err != nil || formBytes > maxResourceFormSize {
+				part.Close()
+				u.discard()
+				return nil, errFormTooLarge
+			}
+			u.fields[part.FormName()] = string(value)
+		}
+		part.Close()
+	}
+	return u, nil
+}
+
+func (u *resourceUpload) spool(part io.Reader) error {
+	tmp, err := os.CreateTemp("", "resource-*")
+	if err != nil {
+		return err
+	}
+	u.tmpPath = tmp.Name()
+
+	hasher := newPieceHasher(resourcePieceSize)
+	head := &headWriter{}
+	n, err := io.Copy(io.MultiWriter(tmp, hasher, head), io.LimitReader(part, maxResourceSize+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if n > maxResourceSize {
+		return errResourceTooLarge
+	}
+
+	u.size = n
+	u.head = head.head
+	u.fileHash, u.pieceHashes = hasher.finish()
+	return nil
+}
@@ -0,0 +1,717 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"main/db"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Room message types. room_message is sent by clients and fanned out to
+// members; room_event announces joins, leaves and role changes.
+const (
+	MsgTypeRoomMessage = "room_message"
+	MsgTypeRoomEvent   = "room_event"
+)
+
+// Room types and member roles
+const (
+	RoomTypeGroup    = "group"
+	RoomTypeResource = "resource"
+
+	RoomRoleOwner  = "owner"
+	RoomRoleAdmin  = "admin"
+	RoomRoleMember = "member"
+)
+
+const (
+	defaultRoomHistoryLimit = 50
+	maxRoomHistoryLimit     = 200
+)
+
+var errNotRoomMember = errors.New("not a member of this room")
+
+// Room is a group or resource discussion room as seen by one member
+type Room struct {
+	ID            int    `json:"id"`
+	Name          string `json:"name"`
+	Type          string `json:"type"`
+	ResourceID    *int   `json:"resource_id,omitempty"`
+	CreatedBy     int    `json:"created_by"`
+	CreatedAt     string `json:"created_at"`
+	Role          string `json:"role,omitempty"`
+	MemberCount   int    `json:"member_count"`
+	LastMessage   string `json:"last_message,omitempty"`
+	LastMessageAt string `json:"last_message_at,omitempty"`
+	UnreadCount   int    `json:"unread_count"`
+}
+
+// RoomMember is one active participant of a room
+type RoomMember struct {
+	UserID       int    `json:"user_id"`
+	Username     string `json:"username"`
+	Name         string `json:"name"`
+	ProfilePhoto string `json:"profile_photo"`
+	Role         string `json:"role"`
+	JoinedAt     string `json:"joined_at"`
+	Online       bool   `json:"online"`
+}
+
+// RoomMessage is one message in a room
+type RoomMessage struct {
+	ID          int    `json:"id"`
+	RoomID      int    `json:"room_id"`
+	SenderID    int    `json:"sender_id"`
+	SenderName  string `json:"sender_name"`
+	Content     string `json:"content"`
+	MessageType string `json:"message_type"`
+	FileID      *int   `json:"file_id"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// roomRole returns the caller's role in a room, or "" if they are not an
+// active member
+func roomRole(roomID, userID int) (string, error) {
+	var role string
+	err := db.DB.QueryRow(`
+		SELECT role FROM resource_chat_participants
+		WHERE room_id = $1 AND user_id = $2 AND is_active
+	`, roomID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// roomMemberIDs returns the active members of a room
+func roomMemberIDs(roomID int) []int {
+	rows, err := db.DB.Query(`SELECT user_id FROM resource_chat_participants WHERE room_id = $1 AND is_active`, roomID)
+	if err != nil {
+		log.Printf("Error loading members of room %d: %v", roomID, err)
+		return nil
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// addRoomMember inserts or reactivates a membership
+func addRoomMember(roomID, userID int, role string) error {
+	_, err := db.DB.Exec(`
+		INSERT INTO resource_chat_participants(room_id, user_id, role, joined_at, last_read_at, is_active)
+		VALUES($1, $2, $3, NOW(), NOW(), true)
+		ON CONFLICT (room_id, user_id)
+		DO UPDATE SET is_active = true, role = EXCLUDED.role, joined_at = NOW()
+	`, roomID, userID, role)
+	return err
+}
+
+// ensureResourceRoom returns the discussion room for a resource swarm,
+// creating it on first use
+func ensureResourceRoom(resourceID int) (int, error) {
+	var title string
+	var uploaderID int
+	err := db.DB.QueryRow(`SELECT title, uploader_id FROM resources WHERE id = $1`, resourceID).Scan(&title, &uploaderID)
+	if err != nil {
+		return 0, err
+	}
+
+	var roomID int
+	err = db.DB.QueryRow(`
+		INSERT INTO resource_chat_rooms(resource_id, room_name, room_type, created_by)
+		VALUES($1, $2, 'resource', $3)
+		ON CONFLICT (resource_id) DO UPDATE SET is_active = true
+		RETURNING id
+	`, resourceID, title+" discussion", uploaderID).Scan(&roomID)
+	if err != nil {
+		return 0, err
+	}
+
+	// The uploader owns the room
+	_, err = db.DB.Exec(`
+		INSERT INTO resource_chat_participants(room_id, user_id, role)
+		VALUES($1, $2, 'owner')
+		ON CONFLICT (room_id, user_id) DO NOTHING
+	`, roomID, uploaderID)
+	return roomID, err
+}
+
+// postRoomMessage persists a room message and delivers it to online members
+func postRoomMessage(roomID, senderID int, content, messageType string, fileID int) (*RoomMessage, error) {
+	msg := &RoomMessage{RoomID: roomID, SenderID: senderID, Content: content, MessageType: messageType}
+
+	var created time.Time
+	err := db.DB.QueryRow(`
+		INSERT INTO resource_messages(room_id, sender_id, content, message_type, file_id)
+		VALUES($1, $2, $3, $4, NULLIF($5, 0))
+		RETURNING id, created_at
+	`, roomID, senderID, content, messageType, fileID).Scan(&msg.ID, &created)
+	if err != nil {
+		return nil, err
+	}
+	msg.CreatedAt = created.UTC().Format(time.RFC3339)
+	if fileID != 0 {
+		msg.FileID = &fileID
+	}
+	db.DB.QueryRow(`SELECT COALESCE(name, username) FROM users WHERE id = $1`, senderID).Scan(&msg.SenderName)
+
+	msgType := MsgTypeRoomMessage
+	if messageType == "system" {
+		msgType = MsgTypeRoomEvent
+	}
+	outgoing := UnifiedMessage{
+		Type:      msgType,
+		UserID:    senderID,
+		RoomID:    roomID,
+		MessageID: msg.ID,
+		Content:   content,
+		FileID:    fileID,
+		IsFile:    fileID != 0,
+		CreatedAt: msg.CreatedAt,
+		Data:      msg,
+		Timestamp: time.Now(),
+	}
+	for _, memberID := range roomMemberIDs(roomID) {
+		unifiedManager.sendToUser(memberID, outgoing)
+	}
+	return msg, nil
+}
+
+// postRoomEvent records a system message such as "alice joined"
+func postRoomEvent(roomID, actorID int, text string) {
+	if _, err := postRoomMessage(roomID, actorID, text, "system", 0); err != nil {
+		log.Printf("Error posting event to room %d: %v", roomID, err)
+	}
+}
+
+func usernameOf(userID int) string {
+	var username string
+	db.DB.QueryRow(`SELECT username FROM users WHERE id = $1`, userID).Scan(&username)
+	return username
+}
+
+func (c *UnifiedClient) handleRoomMessage(message UnifiedMessage) {
+	if until, suspended := suspendedUntil(c.userID); suspended {
+		c.sendError(ErrCodeForbidden, suspensionMessage(until), message.Type)
+		return
+	}
+	role, err := roomRole(message.RoomID, c.userID)
+	if err != nil || role == "" {
+		c.sendError(ErrCodeForbidden, errNotRoomMember.Error(), message.Type)
+		return
+	}
+	decision := filterContent(FilterInput{
+		Kind:     FilterKindRoom,
+		SenderID: c.userID,
+		TargetID: message.RoomID,
+		Content:  message.Content,
+	})
+	if decision.Verdict == VerdictReject {
+		c.sendError(ErrCodeRejected, decision.Reason, message.Type)
+		return
+	}
+
+	messageType := "text"
+	if message.FileID != 0 {
+		if !ownsFile(c.userID, message.FileID) {
+			c.sendError(ErrCodeForbidden, "you can only send files you uploaded", message.Type)
+			return
+		}
+		messageType = "file"
+	} else if strings.TrimSpace(message.Content) == "" {
+		c.sendError(ErrCodeInvalidMessage, "content required", message.Type)
+		return
+	}
+
+	if _, err := postRoomMessage(message.RoomID, c.userID, message.Content, messageType, message.FileID); err != nil {
+		log.Println("insert room message:", err)
+	}
+}
+
+// POST /api/rooms  {user_id, name, member_ids}
+func CreateRoom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		UserID    int    `json:"user_id"`
+		Name      string `json:"name"`
+		MemberIDs []int  `json:"member_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.UserID == 0 || req.Name == "" {
+		http.Error(w, "user_id and name are required", http.StatusBadRequest)
+		return
+	}
+	everyone := append([]int{req.UserID}, req.MemberIDs...)
+	for _, memberID := range req.MemberIDs {
+		if isBlockedWithAny(memberID, everyone) {
+			http.Error(w, "members include users who have blocked each other", http.StatusForbidden)
+			return
+		}
+	}
+
+	var roomID int
+	var created time.Time
+	err := db.DB.QueryRow(`
+		INSERT INTO resource_chat_rooms(room_name, room_type, created_by)
+		VALUES($1, 'group', $2)
+		RETURNING id, created_at
+	`, req.Name, req.UserID).Scan(&roomID, &created)
+	if err != nil {
+		http.Error(w, "Failed to create room: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := addRoomMember(roomID, req.UserID, RoomRoleOwner); err != nil {
+		http.Error(w, "Failed to add owner: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	members := 1
+	for _, memberID := range req.MemberIDs {
+		if memberID == req.UserID {
+			continue
+		}
+		if err := addRoomMember(roomID, memberID, RoomRoleMember); err != nil {
+			log.Printf("Warning: Failed to add user %d to room %d: %v", memberID, roomID, err)
+			continue
+		}
+		members++
+	}
+	postRoomEvent(roomID, req.UserID, fmt.Sprintf("%s created the room", usernameOf(req.UserID)))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Room{
+		ID:          roomID,
+		Name:        req.Name,
+		Type:        RoomTypeGroup,
+		CreatedBy:   req.UserID,
+		CreatedAt:   created.UTC().Format(time.RFC3339),
+		Role:        RoomRoleOwner,
+		MemberCount: members,
+	})
+}
+
+// GET /api/rooms?user_id=1
+func GetRooms(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil || userID <= 0 {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT rm.id, rm.room_name, rm.room_type, rm.resource_id, COALESCE(rm.created_by, 0), rm.created_at, p.role,
+		       (SELECT COUNT(*) FROM resource_chat_participants mp WHERE mp.room_id = rm.id AND mp.is_active),
+		       COALESCE(last.content, ''), last.created_at,
+		       (SELECT COUNT(*) FROM resource_messages um
+		        WHERE um.room_id = rm.id AND um.created_at > p.last_read_at AND um.sender_id != $1)
+		FROM resource_chat_participants p
+		JOIN resource_chat_rooms rm ON rm.id = p.room_id
+		LEFT JOIN LATERAL (
+		  SELECT content, created_at FROM resource_messages
+		  WHERE room_id = rm.id ORDER BY id DESC LIMIT 1
+		) last ON true
+		WHERE p.user_id = $1 AND p.is_active AND rm.is_active
+		ORDER BY COALESCE(last.created_at, rm.created_at) DESC
+	`, userID)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	rooms := make([]Room, 0)
+	for rows.Next() {
+		var room Room
+		var resourceID sql.NullInt32
+		var created time.Time
+		var lastAt sql.NullTime
+		err := rows.Scan(&room.ID, &room.Name, &room.Type, &resourceID, &room.CreatedBy, &created, &room.Role,
+			&room.MemberCount, &room.LastMessage, &lastAt, &room.UnreadCount)
+		if err != nil {
+			continue
+		}
+		room.CreatedAt = created.UTC().Format(time.RFC3339)
+		if resourceID.Valid {
+			v := int(resourceID.Int32)
+			room.ResourceID = &v
+		}
+		if lastAt.Valid {
+			room.LastMessageAt = lastAt.Time.UTC().Format(time.RFC3339)
+		}
+		rooms = append(rooms, room)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rooms)
+}
+
+// POST /api/rooms/join  {user_id, resource_id}
+// Resource rooms are open to anyone with access to the resource; group rooms
+// are joined by invitation through /api/rooms/members.
+func JoinRoom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		UserID     int `json:"user_id"`
+		ResourceID int `json:"resource_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == 0 || req.ResourceID == 0 {
+		http.Error(w, "user_id and resource_id are required", http.StatusBadRequest)
+		return
+	}
+
+	hasAccess, err := hasApprovedConnection(req.UserID, req.ResourceID)
+	if err != nil {
+		http.Error(w, "error checking access: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !hasAccess {
+		http.Error(w, "access denied: approved connection required for this resource", http.StatusForbidden)
+		return
+	}
+
+	roomID, err := ensureResourceRoom(req.ResourceID)
+	if err != nil {
+		http.Error(w, "Failed to open room: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	role, err := roomRole(roomID, req.UserID)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if role == "" {
+		if isBlockedWithAny(req.UserID, roomMemberIDs(roomID)) {
+			http.Error(w, "cannot join a room with a user who has blocked or been blocked by you", http.StatusForbidden)
+			return
+		}
+		if err := addRoomMember(roomID, req.UserID, RoomRoleMember); err != nil {
+			http.Error(w, "Failed to join room: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		role = RoomRoleMember
+		postRoomEvent(roomID, req.UserID, fmt.Sprintf("%s joined", usernameOf(req.UserID)))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"room_id": roomID,
+		"role":    role,
+	})
+}
+
+// POST /api/rooms/leave  {user_id, room_id}
+func LeaveRoom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		UserID int `json:"user_id"`
+		RoomID int `json:"room_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	role, err := roomRole(req.RoomID, req.UserID)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if role == "" {
+		http.Error(w, errNotRoomMember.Error(), http.StatusNotFound)
+		return
+	}
+
+	_, err = db.DB.Exec(`
+		UPDATE resource_chat_participants SET is_active = false, role = 'member'
+		WHERE room_id = $1 AND user_id = $2
+	`, req.RoomID, req.UserID)
+	if err != nil {
+		http.Error(w, "Failed to leave room: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	postRoomEvent(req.RoomID, req.UserID, fmt.Sprintf("%s left", usernameOf(req.UserID)))
+
+	// Hand ownership to the longest-standing admin, then member
+	if role == RoomRoleOwner {
+		_, err = db.DB.Exec(`
+			UPDATE resource_chat_participants SET role = 'owner'
+			WHERE id = (
+				SELECT id FROM resource_chat_participants
+				WHERE room_id = $1 AND is_active
+				ORDER BY CASE role WHEN 'admin' THEN 0 ELSE 1 END, joined_at ASC
+				LIMIT 1
+			)
+		`, req.RoomID)
+		if err != nil {
+			log.Printf("Error transferring ownership of room %d: %v", req.RoomID, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success", "message": "Left room"})
+}
+
+// GET /api/rooms/members?room_id=1&user_id=2
+func GetRoomMembers(w http.ResponseWriter, r *http.Request) {
+	roomID, err1 := strconv.Atoi(r.URL.Query().Get("room_id"))
+	userID, err2 := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err1 != nil || err2 != nil {
+		http.Error(w, "room_id and user_id required", http.StatusBadRequest)
+		return
+	}
+
+	if role, err := roomRole(roomID, userID); err != nil || role == "" {
+		http.Error(w, errNotRoomMember.Error(), http.StatusForbidden)
+		return
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT u.id, u.username, COALESCE(u.name, ''), COALESCE(u.profile_photo, ''), p.role, p.joined_at
+		FROM resource_chat_participants p
+		JOIN users u ON u.id = p.user_id
+		WHERE p.room_id = $1 AND p.is_active
+		ORDER BY CASE p.role WHEN 'owner' THEN 0 WHEN 'admin' THEN 1 ELSE 2 END, u.username
+	`, roomID)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	members := make([]RoomMember, 0)
+	for rows.Next() {
+		var m RoomMember
+		var joined time.Time
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Name, &m.ProfilePhoto, &m.Role, &joined); err != nil {
+			continue
+		}
+		m.JoinedAt = joined.UTC().Format(time.RFC3339)
+		m.Online = IsUserOnline(m.UserID)
+		members = append(members, m)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+// POST /api/rooms/members  {user_id, room_id, target_id, action: "add"|"remove"|"role", role}
+// Owners and admins manage membership; only the owner can change roles.
+func UpdateRoomMembers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		UserID   int    `json:"user_id"`
+		RoomID   int    `json:"room_id"`
+		TargetID int    `json:"target_id"`
+		Action   string `json:"action"`
+		Role     string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.TargetID == 0 || req.TargetID == req.UserID {
+		http.Error(w, "target_id must be another user", http.StatusBadRequest)
+		return
+	}
+
+	actorRole, err := roomRole(req.RoomID, req.UserID)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if actorRole != RoomRoleOwner && actorRole != RoomRoleAdmin {
+		http.Error(w, "only room owners and admins can manage members", http.StatusForbidden)
+		return
+	}
+	targetRole, err := roomRole(req.RoomID, req.TargetID)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var event string
+	switch req.Action {
+	case "add":
+		if targetRole != "" {
+			http.Error(w, "user is already a member", http.StatusConflict)
+			return
+		}
+		if isBlockedWithAny(req.TargetID, append(roomMemberIDs(req.RoomID), req.UserID)) {
+			http.Error(w, "cannot add a user who has blocked or been blocked by a member", http.StatusForbidden)
+			return
+		}
+		err = addRoomMember(req.RoomID, req.TargetID, RoomRoleMember)
+		event = fmt.Sprintf("%s added %s", usernameOf(req.UserID), usernameOf(req.TargetID))
+
+	case "remove":
+		if targetRole == "" {
+			http.Error(w, errNotRoomMember.Error(), http.StatusNotFound)
+			return
+		}
+		if targetRole == RoomRoleOwner || (targetRole == RoomRoleAdmin && actorRole != RoomRoleOwner) {
+			http.Error(w, "cannot remove a member with an equal or higher role", http.StatusForbidden)
+			return
+		}
+		_, err = db.DB.Exec(`
+			UPDATE resource_chat_participants SET is_active = false, role = 'member'
+			WHERE room_id = $1 AND user_id = $2
+		`, req.RoomID, req.TargetID)
+		event = fmt.Sprintf("%s removed %s", usernameOf(req.UserID), usernameOf(req.TargetID))
+
+	case "role":
+		if actorRole != RoomRoleOwner {
+			http.Error(w, "only the room owner can change roles", http.StatusForbidden)
+			return
+		}
+		if targetRole == "" {
+			http.Error(w, errNotRoomMember.Error(), http.StatusNotFound)
+			return
+		}
+		if req.Role != RoomRoleAdmin && req.Role != RoomRoleMember {
+			http.Error(w, "role must be admin or member", http.StatusBadRequest)
+			return
+		}
+		_, err = db.DB.Exec(`
+			UPDATE resource_chat_participants SET role = $3
+			WHERE room_id = $1 AND user_id = $2
+		`, req.RoomID, req.TargetID, req.Role)
+		event = fmt.Sprintf("%s is now %s", usernameOf(req.TargetID), req.Role)
+
+	default:
+		http.Error(w, "action must be add, remove or role", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update members: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	postRoomEvent(req.RoomID, req.UserID, event)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success", "message": event})
+}
+
+// GET /api/rooms/history?room_id=1&user_id=2[&before_id=100][&limit=50]
+// Returns a page of messages oldest-first plus the cursor for the next older page.
+func GetRoomHistory(w http.ResponseWriter, r *http.Request) {
+	roomID, err1 := strconv.Atoi(r.URL.Query().Get("room_id"))
+	userID, err2 := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err1 != nil || err2 != nil {
+		http.Error(w, "room_id and user_id required", http.StatusBadRequest)
+		return
+	}
+	beforeID, _ := strconv.Atoi(r.URL.Query().Get("before_id"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = defaultRoomHistoryLimit
+	} else if limit > maxRoomHistoryLimit {
+		limit = maxRoomHistoryLimit
+	}
+
+	if role, err := roomRole(roomID, userID); err != nil || role == "" {
+		http.Error(w, errNotRoomMember.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Fetch one extra row to know whether an older page exists
+	rows, err := db.DB.Query(`
+		SELECT rm.id, rm.room_id, COALESCE(rm.sender_id, 0), COALESCE(u.name, u.username, ''), rm.content,
+		       rm.message_type, rm.file_id, rm.created_at
+		FROM resource_messages rm
+		LEFT JOIN users u ON u.id = rm.sender_id
+		WHERE rm.room_id = $1 AND ($2 = 0 OR rm.id < $2)
+		ORDER BY rm.id DESC
+		LIMIT $3
+	`, roomID, beforeID, limit+1)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	messages := make([]RoomMessage, 0, limit)
+	for rows.Next() {
+		var m RoomMessage
+		var fileID sql.NullInt32
+		var created time.Time
+		err := rows.Scan(&m.ID, &m.RoomID, &m.SenderID, &m.SenderName, &m.Content, &m.MessageType, &fileID, &created)
+		if err != nil {
+			continue
+		}
+		if fileID.Valid {
+			v := int(fileID.Int32)
+			m.FileID = &v
+		}
+		m.CreatedAt = created.UTC().Format(time.RFC3339)
+		messages = append(messages, m)
+	}
+
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	var nextBeforeID int
+	if hasMore && len(messages) > 0 {
+		nextBeforeID = messages[0].ID
+	}
+
+	// Reading the newest page marks the room as read
+	if beforeID == 0 {
+		_, err = db.DB.Exec(`
+			UPDATE resource_chat_participants SET last_read_at = NOW()
+			WHERE room_id = $1 AND user_id = $2
+		`, roomID, userID)
+		if err != nil {
+			log.Printf("Error updating last_read_at for room %d: %v", roomID, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"messages":       messages,
+		"has_more":       hasMore,
+		"next_before_id": nextBeforeID,
+	})
+}
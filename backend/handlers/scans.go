@@ -0,0 +1,325 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"main/db"
+	"main/scanner"
+	"main/storage"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Malware scanning
+//
+// Attachments and resources are stored as pending and scanned in the
+// background by scanner.Default. Only clean content is served; pending
+// content is retried later and quarantined content is refused for good
+// unless a moderator releases it. Resource content is scanned once per hash
+// and the verdict applies to every resource sharing it.
+
+// Scan statuses of files and resources
+const (
+	ScanStatusPending     = "pending"
+	ScanStatusClean       = "clean"
+	ScanStatusQuarantined = "quarantined"
+)
+
+const (
+	scanInterval = 30 * time.Second
+	scanBatch    = 10
+	// A claimed scan that has not finished by then is retried, by this
+	// replica or another
+	scanLease = 10 * time.Minute
+)
+
+var (
+	errQuarantined = errors.New("content quarantined by the malware scanner")
+	errScanPending = errors.New("content is still being scanned")
+
+	// scanWake lets an upload start a scan without waiting for the ticker
+	scanWake = make(chan struct{}, 1)
+)
+
+// requestScan wakes the scan worker
+func requestScan() {
+	select {
+	case scanWake <- struct{}{}:
+	default:
+	}
+}
+
+// scanStatusError maps a scan status to the error that refuses serving it
+func scanStatusError(status string) error {
+	switch status {
+	case ScanStatusClean:
+		return nil
+	case ScanStatusQuarantined:
+		return errQuarantined
+	}
+	return errScanPending
+}
+
+// writeScanError answers a download of content that is not clean
+func writeScanError(w http.ResponseWriter, err error) {
+	if err == errQuarantined {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(scanInterval.Seconds())))
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+}
+
+// StartScanWorker scans pending uploads as they arrive
+func StartScanWorker() {
+	go func() {
+		ticker := time.NewTicker(scanInterval)
+		defer ticker.Stop()
+		for {
+			scanPending()
+			select {
+			case <-ticker.C:
+			case <-scanWake:
+			}
+		}
+	}()
+}
+
+// scanPending works through everything pending, a batch at a time
+func scanPending() {
+	for {
+		files, err := claimPendingFiles()
+		if err != nil {
+			log.Printf("Error claiming files to scan: %v", err)
+			return
+		}
+		hashes, err := claimPendingResources()
+		if err != nil {
+			log.Printf("Error claiming resources to scan: %v", err)
+			return
+		}
+		if len(files) == 0 && len(hashes) == 0 {
+			return
+		}
+
+		for id, storedName := range files {
+			result, err := scanBlob(storage.PrefixUploads + storedName)
+			if err != nil {
+				log.Printf("Error scanning file %d: %v", id, err)
+				continue
+			}
+			recordScan(`UPDATE files SET scan_status = $2, scan_signature = NULLIF($3, ''), scanned_at = NOW()
+				WHERE id = $1 AND scan_status = 'pending'`, id, result)
+		}
+		for _, hash := range hashes {
+			var key string
+			if err := db.DB.QueryRow(`SELECT storage_key FROM resource_blobs WHERE file_hash = $1`, hash).Scan(&key); err != nil {
+				log.Printf("Error finding blob %s to scan: %v", hash, err)
+				continue
+			}
+			result, err := scanBlob(key)
+			if err != nil {
+				log.Printf("Error scanning blob %s: %v", hash, err)
+				continue
+			}
+			recordScan(`UPDATE resources SET scan_status = $2, scan_signature = NULLIF($3, ''), scanned_at = NOW()
+				WHERE file_hash = $1 AND scan_status = 'pending'`, hash, result)
+		}
+	}
+}
+
+// claimPendingFiles leases a batch of unscanned attachments
+func claimPendingFiles() (map[int]string, error) {
+	rows, err := db.DB.Query(`
+		UPDATE files SET scan_started_at = NOW()
+		WHERE id IN (
+			SELECT id FROM files
+			WHERE scan_status = 'pending'
+			AND (scan_started_at IS NULL OR scan_started_at < NOW() - make_interval(secs => $1))
+			ORDER BY id LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, stored_name
+	`, scanLease.Seconds(), scanBatch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	files := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var storedName string
+		if rows.Scan(&id, &storedName) == nil {
+			files[id] = storedName
+		}
+	}
+	return files, rows.Err()
+}
+
+// claimPendingResources leases a batch of unscanned resources and returns
+// their distinct content hashes
+func claimPendingResources() ([]string, error) {
+	rows, err := db.DB.Query(`
+		UPDATE resources SET scan_started_at = NOW()
+		WHERE id IN (
+			SELECT id FROM resources
+			WHERE scan_status = 'pending' AND file_hash IS NOT NULL
+			AND (scan_started_at IS NULL OR scan_started_at < NOW() - make_interval(secs => $1))
+			ORDER BY id LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING file_hash
+	`, scanLease.Seconds(), scanBatch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	seen := make(map[string]bool)
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if rows.Scan(&hash) == nil && !seen[hash] {
+			seen[hash] = true
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes, rows.Err()
+}
+
+func scanBlob(key string) (scanner.Result, error) {
+	rc, err := storage.Blobs.Get(key, 0, -1)
+	if err != nil {
+		return scanner.Result{}, err
+	}
+	defer rc.Close()
+	return scanner.Default.Scan(rc)
+}
+
+func recordScan(query string, target any, result scanner.Result) {
+	status := ScanStatusClean
+	if result.Infected {
+		status = ScanStatusQuarantined
+		log.Printf("Quarantined %v: %s", target, result.Signature)
+	}
+	if _, err := db.DB.Exec(query, target, status, result.Signature); err != nil {
+		log.Printf("Error recording scan of %v: %v", target, err)
+	}
+}
+
+// GET /api/moderation/quarantine?moderator_id=1
+// Lists quarantined attachments and resources.
+func GetQuarantine(w http.ResponseWriter, r *http.Request) {
+	moderatorID, _ := strconv.Atoi(r.URL.Query().Get("moderator_id"))
+	if !isModerator(moderatorID) {
+		http.Error(w, errNotModerator.Error(), http.StatusForbidden)
+		return
+	}
+
+	type quarantined struct {
+		TargetType string `json:"target_type"`
+		TargetID   int    `json:"target_id"`
+		Name       string `json:"name"`
+		UploaderID int    `json:"uploader_id"`
+		Signature  string `json:"signature"`
+		ScannedAt  string `json:"scanned_at"`
+	}
+	rows, err := db.DB.Query(`
+		SELECT 'file', id, filename, uploader_id, COALESCE(scan_signature, ''), scanned_at
+		FROM files WHERE scan_status = 'quarantined'
+		UNION ALL
+		SELECT 'resource', id, title, COALESCE(uploader_id, 0), COALESCE(scan_signature, ''), scanned_at
+		FROM resources WHERE scan_status = 'quarantined'
+		ORDER BY 6 DESC
+	`)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	items := []quarantined{}
+	for rows.Next() {
+		var q quarantined
+		var scannedAt sql.NullTime
+		if rows.Scan(&q.TargetType, &q.TargetID, &q.Name, &q.UploaderID, &q.Signature, &scannedAt) != nil {
+			continue
+		}
+		q.ScannedAt = nullTimeToString(scannedAt)
+		items = append(items, q)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// POST /api/moderation/quarantine  {moderator_id, target_type: "file"|"resource", target_id, action: "release"|"rescan"}
+// release marks a false positive clean; rescan queues the content again.
+// For resources both apply to every resource sharing the same content.
+func UpdateQuarantine(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ModeratorID int    `json:"moderator_id"`
+		TargetType  string `json:"target_type"`
+		TargetID    int    `json:"target_id"`
+		Action      string `json:"action"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !isModerator(req.ModeratorID) {
+		http.Error(w, errNotModerator.Error(), http.StatusForbidden)
+		return
+	}
+
+	var status string
+	switch req.Action {
+	case "release":
+		status = ScanStatusClean
+	case "rescan":
+		status = ScanStatusPending
+	default:
+		http.Error(w, "action must be release or rescan", http.StatusBadRequest)
+		return
+	}
+
+	var res sql.Result
+	var err error
+	switch req.TargetType {
+	case "file":
+		res, err = db.DB.Exec(`
+			UPDATE files SET scan_status = $2, scan_signature = NULL, scan_started_at = NULL, scanned_at = NOW()
+			WHERE id = $1
+		`, req.TargetID, status)
+	case "resource":
+		res, err = db.DB.Exec(`
+			UPDATE resources SET scan_status = $2, scan_signature = NULL, scan_started_at = NULL, scanned_at = NOW()
+			WHERE file_hash = (SELECT file_hash FROM resources WHERE id = $1)
+		`, req.TargetID, status)
+	default:
+		http.Error(w, "target_type must be file or resource", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("Moderator %d: %s %s %d", req.ModeratorID, req.Action, req.TargetType, req.TargetID)
+	if status == ScanStatusPending {
+		requestScan()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      "success",
+		"target_type": req.TargetType,
+		"target_id":   req.TargetID,
+		"scan_status": status,
+	})
+}
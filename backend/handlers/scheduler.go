@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"main/db"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MsgTypeScheduled tells the sender a scheduled message was queued or sent;
+// the state is carried in Status
+const MsgTypeScheduled = "scheduled"
+
+// Scheduled message states
+const (
+	ScheduledQueued = "queued"
+	ScheduledSent   = "sent"
+)
+
+// DeleteExpired is the scope of message_deleted events sent by the sweeper
+const DeleteExpired = "expired"
+
+const (
+	schedulerInterval = 5 * time.Second
+	sweeperInterval   = 30 * time.Second
+
+	// send_at closer than this is treated as "now"
+	minScheduleDelay = 5 * time.Second
+	maxScheduleAhead = 30 * 24 * time.Hour
+	minExpiry        = 10 * time.Second
+	maxExpiry        = 30 * 24 * time.Hour
+)
+
+// ScheduledMessage is one queued message as seen by its sender
+type ScheduledMessage struct {
+	ID         int     `json:"id"`
+	ReceiverID int     `json:"receiver_id"`
+	Content    string  `json:"content"`
+	IsFile     bool    `json:"is_file"`
+	FileID     *int    `json:"file_id"`
+	SendAt     string  `json:"send_at"`
+	ExpiresAt  *string `json:"expires_at"`
+	CreatedAt  string  `json:"created_at"`
+}
+
+// messageTiming is the parsed send_at/expires_at of an outgoing message
+type messageTiming struct {
+	sendAt    *time.Time // nil sends immediately
+	expiresAt *time.Time // nil never expires
+}
+
+// parseMessageTiming validates the optional send_at and expires_at fields of
+// a chat message. The times are returned in UTC: the columns have no time
+// zone, so an offset would be dropped on insert.
+func parseMessageTiming(sendAt, expiresAt string) (messageTiming, error) {
+	var timing messageTiming
+	now := time.Now().UTC()
+	effective := now
+
+	if sendAt != "" {
+		t, err := time.Parse(time.RFC3339, sendAt)
+		if err != nil {
+			return timing, errors.New("send_at must be an RFC 3339 time")
+		}
+		t = t.UTC()
+		if t.After(now.Add(maxScheduleAhead)) {
+			return timing, errors.New("send_at is too far in the future")
+		}
+		if t.After(now.Add(minScheduleDelay)) {
+			timing.sendAt = &t
+			effective = t
+		}
+	}
+
+	if expiresAt != "" {
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return timing, errors.New("expires_at must be an RFC 3339 time")
+		}
+		t = t.UTC()
+		lifetime := t.Sub(effective)
+		if lifetime < minExpiry || lifetime > maxExpiry {
+			return timing, errors.New("expires_at must be between 10 seconds and 30 days after the message is sent")
+		}
+		timing.expiresAt = &t
+	}
+	return timing, nil
+}
+
+// StartMessageScheduler starts the goroutines that release scheduled
+// messages and purge expired ones
+func StartMessageScheduler() {
+	go func() {
+		ticker := time.NewTicker(schedulerInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			releaseDueMessages()
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(sweeperInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			sweepExpiredMessages()
+		}
+	}()
+}
+
+// releaseDueMessages delivers scheduled messages whose send_at has passed.
+// The row is claimed by the UPDATE, so concurrent instances never deliver
+// the same message twice. Messages between users who have since blocked
+// each other stay queued until the sender cancels them.
+func releaseDueMessages() {
+	rows, err := db.DB.Query(`
+		UPDATE messages SET released = true, created_at = NOW()
+		WHERE NOT released AND send_at <= NOW() AND deleted_at IS NULL AND removed_at IS NULL
+		AND NOT EXISTS (
+			SELECT 1 FROM user_blocks b
+			WHERE (b.blocker_id = messages.sender_id AND b.blocked_id = messages.receiver_id)
+			   OR (b.blocker_id = messages.receiver_id AND b.blocked_id = messages.sender_id)
+		)
+		RETURNING id, sender_id, receiver_id, COALESCE(content, ''), is_file, file_id,
+		          COALESCE(reply_to_id, 0), created_at, expires_at, COALESCE(ciphertext, ''), e2ee_header
+	`)
+	if err != nil {
+		log.Printf("Error releasing scheduled messages: %v", err)
+		return
+	}
+
+	var due []UnifiedMessage
+	for rows.Next() {
+		var msg UnifiedMessage
+		var fileID sql.NullInt32
+		var created time.Time
+		var expiresAt sql.NullTime
+		var header []byte
+		err := rows.Scan(&msg.MessageID, &msg.UserID, &msg.ReceiverID, &msg.Content, &msg.IsFile, &fileID,
+			&msg.ReplyToID, &created, &expiresAt, &msg.Ciphertext, &header)
+		if err != nil {
+			continue
+		}
+		msg.Type = MsgTypeChat
+		if fileID.Valid {
+			msg.Type = MsgTypeFile
+			msg.FileID = int(fileID.Int32)
+		}
+		msg.E2EE = decodeE2EEHeader(header)
+		msg.CreatedAt = created.UTC().Format(time.RFC3339)
+		if expiresAt.Valid {
+			msg.ExpiresAt = expiresAt.Time.UTC().Format(time.RFC3339)
+		}
+		msg.Timestamp = time.Now()
+		due = append(due, msg)
+	}
+	rows.Close()
+
+	for _, msg := range due {
+		unarchiveOnActivity(msg.UserID, msg.ReceiverID)
+		msg.Silent = isMuted(msg.ReceiverID, msg.UserID)
+
+		if IsUserOnline(msg.ReceiverID) {
+			unifiedManager.sendToUser(msg.ReceiverID, msg)
+			db.DB.Exec(`UPDATE messages SET delivered = true WHERE id = $1`, msg.MessageID)
+		}
+		unifiedManager.sendToUser(msg.UserID, UnifiedMessage{
+			Type:       MsgTypeScheduled,
+			UserID:     msg.UserID,
+			ReceiverID: msg.ReceiverID,
+			MessageID:  msg.MessageID,
+			Status:     ScheduledSent,
+			CreatedAt:  msg.CreatedAt,
+			Timestamp:  time.Now(),
+		})
+	}
+}
+
+// sweepExpiredMessages purges the content of expired messages, keeping a
+// tombstone like delete-for-everyone, and tells both participants
+func sweepExpiredMessages() {
+	rows, err := db.DB.Query(`
+		UPDATE messages SET deleted_at = NOW(), content = NULL, file_id = NULL, ciphertext = NULL, e2ee_header = NULL
+		WHERE expires_at <= NOW() AND deleted_at IS NULL
+		RETURNING id, sender_id, receiver_id, released
+	`)
+	if err != nil {
+		log.Printf("Error sweeping expired messages: %v", err)
+		return
+	}
+
+	var expired []MessageUpdate
+	var released []bool
+	for rows.Next() {
+		var update MessageUpdate
+		var wasReleased bool
+		if err := rows.Scan(&update.MessageID, &update.SenderID, &update.ReceiverID, &wasReleased); err != nil {
+			continue
+		}
+		update.Scope = DeleteExpired
+		expired = append(expired, update)
+		released = append(released, wasReleased)
+	}
+	rows.Close()
+
+	for i := range expired {
+		update := &expired[i]
+		if _, err := db.DB.Exec(`DELETE FROM message_edits WHERE message_id = $1`, update.MessageID); err != nil {
+			log.Printf("Error purging edits of expired message %d: %v", update.MessageID, err)
+		}
+		if released[i] {
+			notifyMessageParticipants(MsgTypeMessageDeleted, update.SenderID, update, update.SenderID, update.ReceiverID)
+		} else {
+			notifyMessageParticipants(MsgTypeMessageDeleted, update.SenderID, update, update.SenderID)
+		}
+	}
+	if len(expired) > 0 {
+		log.Printf("Purged %d expired messages", len(expired))
+	}
+}
+
+// GET /api/messages/scheduled?user_id=1[&partner_id=2]
+// Lists the caller's messages that have not been sent yet. Cancel one with
+// /api/messages/delete and scope "everyone".
+func GetScheduledMessages(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil || userID <= 0 {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return
+	}
+	partnerID, _ := strconv.Atoi(r.URL.Query().Get("partner_id"))
+
+	rows, err := db.DB.Query(`
+		SELECT id, receiver_id, COALESCE(content, ''), is_file, file_id, send_at, expires_at, created_at
+		FROM messages
+		WHERE sender_id = $1 AND NOT released AND deleted_at IS NULL
+		AND ($2 = 0 OR receiver_id = $2)
+		ORDER BY send_at ASC
+	`, userID, partnerID)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	scheduled := make([]ScheduledMessage, 0)
+	for rows.Next() {
+		var m ScheduledMessage
+		var fileID sql.NullInt32
+		var sendAt, created time.Time
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&m.ID, &m.ReceiverID, &m.Content, &m.IsFile, &fileID, &sendAt, &expiresAt, &created); err != nil {
+			continue
+		}
+		if fileID.Valid {
+			v := int(fileID.Int32)
+			m.FileID = &v
+		}
+		m.SendAt = sendAt.UTC().Format(time.RFC3339)
+		if expiresAt.Valid {
+			v := expiresAt.Time.UTC().Format(time.RFC3339)
+			m.ExpiresAt = &v
+		}
+		m.CreatedAt = created.UTC().Format(time.RFC3339)
+		scheduled = append(scheduled, m)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(scheduled)
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html"
+	"main/db"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSearchLimit   = 20
+	maxSearchLimit       = 100
+	defaultHistoryRadius = 25
+	maxHistoryRadius     = 200
+)
+
+// ts_headline wraps matches in these control characters so the snippet can be
+// HTML-escaped before the <mark> tags go in
+const (
+	highlightStart = "\x02"
+	highlightStop  = "\x03"
+)
+
+// SearchResult is one matching message from the caller's conversations
+type SearchResult struct {
+	MessageID       int    `json:"message_id"`
+	SenderID        int    `json:"sender_id"`
+	PartnerID       int    `json:"partner_id"`
+	PartnerUsername string `json:"partner_username"`
+	PartnerName     string `json:"partner_name"`
+	IsFile          bool   `json:"is_file"`
+	FileID          *int   `json:"file_id"`
+	FileName        string `json:"file_name,omitempty"`
+	Snippet         string `json:"snippet"`
+	CreatedAt       string `json:"created_at"`
+}
+
+// parseSearchDate accepts RFC 3339 or a plain date. A plain date used as the
+// upper bound covers the whole day. Times are converted to UTC, since the
+// ::timestamp cast would drop their offset.
+func parseSearchDate(value string, endOfDay bool) (interface{}, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return nil, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// highlightSnippet escapes a ts_headline fragment and turns the match markers
+// into <mark> tags
+func highlightSnippet(fragment string) string {
+	escaped := html.EscapeString(fragment)
+	escaped = strings.ReplaceAll(escaped, highlightStart, "<mark>")
+	return strings.ReplaceAll(escaped, highlightStop, "</mark>")
+}
+
+// historyWindow returns the id range covering radius messages either side of
+// aroundID in the conversation between two users
+func historyWindow(user1, user2 string, aroundID, radius int) (int, int, error) {
+	var fromID, toID int
+	err := db.DB.QueryRow(`
+		SELECT
+			COALESCE((SELECT MIN(id) FROM (
+				SELECT id FROM messages
+				WHERE ((sender_id=$1 AND receiver_id=$2) OR (sender_id=$2 AND receiver_id=$1)) AND id <= $3
+				ORDER BY id DESC LIMIT $4
+			) older), $3),
+			COALESCE((SELECT MAX(id) FROM (
+				SELECT id FROM messages
+				WHERE ((sender_id=$1 AND receiver_id=$2) OR (sender_id=$2 AND receiver_id=$1)) AND id >= $3
+				ORDER BY id ASC LIMIT $4
+			) newer), $3)
+	`, user1, user2, aroundID, radius+1).Scan(&fromID, &toID)
+	return fromID, toID, err
+}
+
+// GET /api/messages/search?user_id=1&q=term[&partner_id=2][&from=2024-01-01][&to=2024-02-01][&before_id=100][&limit=20]
+// Results are newest first. Open one in context with
+// /api/history?user1=<user_id>&user2=<partner_id>&around_id=<message_id>.
+func SearchMessages(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	userID, err := strconv.Atoi(query.Get("user_id"))
+	if err != nil || userID <= 0 {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return
+	}
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		http.Error(w, "q required", http.StatusBadRequest)
+		return
+	}
+	partnerID, _ := strconv.Atoi(query.Get("partner_id"))
+	beforeID, _ := strconv.Atoi(query.Get("before_id"))
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	} else if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+
+	from, err := parseSearchDate(query.Get("from"), false)
+	if err != nil {
+		http.Error(w, "from must be a date (YYYY-MM-DD) or RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+	to, err := parseSearchDate(query.Get("to"), true)
+	if err != nil {
+		http.Error(w, "to must be a date (YYYY-MM-DD) or RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+
+	headlineOpts := "StartSel=" + highlightStart + ", StopSel=" + highlightStop +
+		", MaxWords=24, MinWords=8, MaxFragments=2, FragmentDelimiter=\" … \""
+
+	// Fetch one extra row to know whether an older page exists
+	rows, err := db.DB.Query(`
+		WITH q AS (SELECT websearch_to_tsquery('simple', $2) AS query),
+		matches AS (
+			SELECT m.id, m.sender_id, m.is_file, m.file_id, m.created_at,
+			       CASE WHEN m.sender_id = $1 THEN m.receiver_id ELSE m.sender_id END AS partner_id,
+			       COALESCE(f.filename, '') AS filename,
+			       CASE WHEN m.is_file THEN COALESCE(f.filename, '') ELSE COALESCE(m.content, '') END AS body
+			FROM messages m
+			CROSS JOIN q
+			LEFT JOIN files f ON f.id = m.file_id
+			WHERE (m.sender_id = $1 OR m.receiver_id = $1)
+			AND m.deleted_at IS NULL AND m.removed_at IS NULL AND m.released
+			AND (m.search_vector @@ q.query OR f.search_vector @@ q.query)
+			AND NOT EXISTS (SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $1)
+			AND ($3 = 0 OR m.sender_id = $3 OR m.receiver_id = $3)
+			AND ($4::timestamp IS NULL OR m.created_at >= $4)
+			AND ($5::timestamp IS NULL OR m.created_at < $5)
+			AND ($6 = 0 OR m.id < $6)
+			ORDER BY m.id DESC
+			LIMIT $7
+		)
+		SELECT mt.id, mt.sender_id, mt.partner_id, u.username, COALESCE(u.name, ''), mt.is_file, mt.file_id,
+		       mt.filename, ts_headline('simple', mt.body, q.query, $8), mt.created_at
+		FROM matches mt
+		CROSS JOIN q
+		JOIN users u ON u.id = mt.partner_id
+		ORDER BY mt.id DESC
+	`, userID, q, partnerID, from, to, beforeID, limit+1, headlineOpts)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	results := make([]SearchResult, 0, limit)
+	for rows.Next() {
+		var res SearchResult
+		var fileID sql.NullInt32
+		var created time.Time
+		err := rows.Scan(&res.MessageID, &res.SenderID, &res.PartnerID, &res.PartnerUsername, &res.PartnerName,
+			&res.IsFile, &fileID, &res.FileName, &res.Snippet, &created)
+		if err != nil {
+			continue
+		}
+		if fileID.Valid {
+			v := int(fileID.Int32)
+			res.FileID = &v
+		}
+		res.Snippet = highlightSnippet(res.Snippet)
+		res.CreatedAt = created.UTC().Format(time.RFC3339)
+		results = append(results, res)
+	}
+
+	hasMore := len(results) > limit
+	if hasMore {
+		results = results[:limit]
+	}
+	var nextBeforeID int
+	if hasMore {
+		nextBeforeID = results[len(results)-1].MessageID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results":        results,
+		"has_more":       hasMore,
+		"next_before_id": nextBeforeID,
+	})
+}
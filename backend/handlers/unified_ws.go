@@ -1,7 +1,11 @@
 package handlers
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"log"
 	"main/db"
 	"net/http"
@@ -24,19 +28,41 @@ type UnifiedMessage struct {
 	Type       string `json:"type"`
 	UserID     int    `json:"user_id"`
 	ReceiverID int    `json:"receiver_id,omitempty"`
+	RoomID     int    `json:"room_id,omitempty"`
+	MessageID  int    `json:"message_id,omitempty"`
+	ReplyToID  int    `json:"reply_to_id,omitempty"`
+	Scope      string `json:"scope,omitempty"`
+	Emoji      string `json:"emoji,omitempty"`
 	Content    string `json:"content,omitempty"`
 	FileID     int    `json:"file_id,omitempty"`
 	IsFile     bool   `json:"is_file,omitempty"`
+	Silent     bool   `json:"silent,omitempty"`
 	CreatedAt  string `json:"created_at,omitempty"`
+	SendAt     string `json:"send_at,omitempty"`
+	ExpiresAt  string `json:"expires_at,omitempty"`
+
+	// End-to-end encrypted chat: Content is empty and the payload is opaque
+	Ciphertext string      `json:"ciphertext,omitempty"`
+	E2EE       *E2EEHeader `json:"e2ee,omitempty"`
 
 	// P2P specific fields
 	ResourceID int        `json:"resource_id,omitempty"`
 	PieceIndex int        `json:"piece_index,omitempty"`
 	PieceData  []byte     `json:"piece_data,omitempty"`
+	Offset     int64      `json:"offset,omitempty"`
+	PieceHash  string     `json:"piece_hash,omitempty"`
 	PeerList   []PeerInfo `json:"peer_list,omitempty"`
 	SwarmStats SwarmStats `json:"swarm_stats,omitempty"`
 	Data       any        `json:"data,omitempty"`
 	Timestamp  time.Time  `json:"timestamp"`
+
+	// Handshake fields
+	ProtocolVersion int      `json:"protocol_version,omitempty"`
+	Capabilities    []string `json:"capabilities,omitempty"`
+
+	// Presence fields
+	Status string `json:"status,omitempty"`
+	Idle   bool   `json:"idle,omitempty"`
 }
 
 // UnifiedClient represents a unified WebSocket client
@@ -45,8 +71,12 @@ type UnifiedClient struct {
 	conn      *websocket.Conn
 	send      chan UnifiedMessage
 	resources map[int]bool // Resources this client is participating in (for P2P)
+	binary    bool         // Negotiated skillswap.v2: piece data travels in binary frames
 	lastPing  time.Time
 	mu        sync.Mutex
+
+	protocolVersion int
+	capabilities    map[string]bool
 }
 
 // UnifiedManager manages all WebSocket connections
@@ -65,6 +95,8 @@ var unifiedManager = &UnifiedManager{
 	unregister: make(chan *UnifiedClient),
 	broadcast:  make(chan UnifiedMessage),
 	upgrader: websocket.Upgrader{
+		Subprotocols:      []string{SubprotocolV2},
+		EnableCompression: true,
 		CheckOrigin: func(r *http.Request) bool {
 			return true // Allow all origins for development
 		},
@@ -88,29 +120,20 @@ func (m *UnifiedManager) run() {
 			// Send pending chat messages
 			go m.sendPendingMessages(client)
 
-			// Notify other clients about new peer (for P2P)
-			message := UnifiedMessage{
-				Type:      PeerConnect,
-				UserID:    client.userID,
-				Timestamp: time.Now(),
-			}
-			m.broadcastToOthers(client.userID, message)
+			// Notify related users that this user came online
+			go presence.connected(client.userID)
 
 		case client := <-m.unregister:
 			m.mu.Lock()
-			if _, ok := m.clients[client.userID]; ok {
+			// A reconnect may already have replaced this client
+			if current, ok := m.clients[client.userID]; ok && current == client {
 				delete(m.clients, client.userID)
 				close(client.send)
 				log.Printf("Unified client disconnected: user %d", client.userID)
-
-				// Notify other clients about peer disconnect (for P2P)
-				message := UnifiedMessage{
-					Type:      PeerDisconnect,
-					UserID:    client.userID,
-					Timestamp: time.Now(),
-				}
 				m.mu.Unlock()
-				m.broadcastToOthers(client.userID, message)
+
+				// Notify related users that this user went offline
+				go presence.disconnected(client.userID)
 			} else {
 				m.mu.Unlock()
 			}
@@ -194,11 +217,24 @@ func (m *UnifiedManager) sendToUser(userID int, message UnifiedMessage) {
 	}
 }
 
+// sendToUserWithCapability delivers a message only if the user is connected
+// and negotiated the given capability
+func (m *UnifiedManager) sendToUserWithCapability(userID int, capability string, message UnifiedMessage) {
+	m.mu.RLock()
+	client, ok := m.clients[userID]
+	m.mu.RUnlock()
+
+	if ok && client.hasCapability(capability) {
+		m.sendToUser(userID, message)
+	}
+}
+
 func (m *UnifiedManager) sendPendingMessages(c *UnifiedClient) {
 	rows, err := db.DB.Query(`
-		SELECT id, sender_id, receiver_id, content, is_file, file_id, created_at
+		SELECT id, sender_id, receiver_id, COALESCE(content, ''), is_file, file_id, created_at, COALESCE(reply_to_id, 0),
+		       COALESCE(ciphertext, ''), e2ee_header
 		FROM messages
-		WHERE receiver_id=$1 AND delivered=false
+		WHERE receiver_id=$1 AND delivered=false AND released AND deleted_at IS NULL AND removed_at IS NULL
 		ORDER BY created_at ASC
 	`, c.userID)
 	if err != nil {
@@ -214,8 +250,10 @@ func (m *UnifiedManager) sendPendingMessages(c *UnifiedClient) {
 		var id int
 		var msg UnifiedMessage
 		var fileID sql.NullInt32
+		var header []byte
 
-		err := rows.Scan(&id, &msg.UserID, &msg.ReceiverID, &msg.Content, &msg.IsFile, &fileID, &msg.CreatedAt)
+		err := rows.Scan(&id, &msg.UserID, &msg.ReceiverID, &msg.Content, &msg.IsFile, &fileID, &msg.CreatedAt, &msg.ReplyToID,
+			&msg.Ciphertext, &header)
 		if err != nil {
 			log.Printf("Error scanning pending message: %v", err)
 			continue
@@ -228,7 +266,10 @@ func (m *UnifiedManager) sendPendingMessages(c *UnifiedClient) {
 		} else {
 			msg.Type = MsgTypeChat
 		}
+		msg.MessageID = id
+		msg.E2EE = decodeE2EEHeader(header)
 		msg.Timestamp = time.Now()
+		msg.Silent = isMuted(msg.ReceiverID, msg.UserID)
 
 		pendingMsgs = append(pendingMsgs, msg)
 		msgIDs = append(msgIDs, id)
@@ -265,17 +306,21 @@ func (c *UnifiedClient) readPump() {
 		c.conn.Close()
 	}()
 
-	c.conn.SetReadLimit(512 * 1024) // 512KB max message size
-	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	// v2 clients may send a full piece in a single binary frame
+	if c.binary {
+		c.conn.SetReadLimit(maxBinaryMessageSize)
+	} else {
+		c.conn.SetReadLimit(maxJSONMessageSize)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(readTimeout))
 	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		c.conn.SetReadDeadline(time.Now().Add(readTimeout))
 		c.lastPing = time.Now()
 		return nil
 	})
 
 	for {
-		var message UnifiedMessage
-		err := c.conn.ReadJSON(&message)
+		frameType, data, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("Unified WebSocket error: %v", err)
@@ -283,6 +328,28 @@ func (c *UnifiedClient) readPump() {
 			break
 		}
 
+		var message UnifiedMessage
+		if frameType == websocket.BinaryMessage {
+			if !c.binary {
+				c.sendError(ErrCodeInvalidMessage, "binary frames require the "+SubprotocolV2+" sub-protocol", "")
+				continue
+			}
+			message, err = decodePieceFrame(data)
+			if err != nil {
+				c.sendError(ErrCodeInvalidMessage, err.Error(), PieceResponse)
+				continue
+			}
+		} else {
+			if len(data) > maxJSONMessageSize {
+				c.sendError(ErrCodeInvalidMessage, "control message exceeds max_message_size", "")
+				continue
+			}
+			if err := json.Unmarshal(data, &message); err != nil {
+				c.sendError(ErrCodeInvalidMessage, "malformed JSON message", "")
+				continue
+			}
+		}
+
 		message.UserID = c.userID
 		message.Timestamp = time.Now()
 		c.handleMessage(message)
@@ -290,7 +357,7 @@ func (c *UnifiedClient) readPump() {
 }
 
 func (c *UnifiedClient) writePump() {
-	ticker := time.NewTicker(54 * time.Second)
+	ticker := time.NewTicker(pingInterval)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
@@ -299,19 +366,19 @@ func (c *UnifiedClient) writePump() {
 	for {
 		select {
 		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
 			if !ok {
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
-			if err := c.conn.WriteJSON(message); err != nil {
+			if err := c.writeMessage(message); err != nil {
 				log.Printf("Unified WebSocket write error: %v", err)
 				return
 			}
 
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
@@ -319,8 +386,36 @@ func (c *UnifiedClient) writePump() {
 	}
 }
 
+// writeMessage sends piece data as a binary frame to clients that negotiated
+// binary pieces and everything else as JSON
+func (c *UnifiedClient) writeMessage(message UnifiedMessage) error {
+	c.conn.EnableWriteCompression(c.hasCapability(CapCompression))
+	if c.hasCapability(CapBinaryPieces) && message.Type == PieceResponse && len(message.PieceData) > 0 {
+		return c.conn.WriteMessage(websocket.BinaryMessage, encodePieceFrame(message))
+	}
+	return c.conn.WriteJSON(message)
+}
+
 func (c *UnifiedClient) handleMessage(message UnifiedMessage) {
 	switch message.Type {
+	case MsgTypeHello:
+		c.handleHello(message)
+	case MsgTypePresence:
+		c.handlePresence(message)
+	case MsgTypeHeartbeat:
+		c.handleHeartbeat(message)
+	case MsgTypeTyping:
+		c.handleTyping(message)
+	case MsgTypeRead:
+		c.handleRead(message)
+	case MsgTypeEdit:
+		c.handleEdit(message)
+	case MsgTypeDelete:
+		c.handleDelete(message)
+	case MsgTypeReactionAdd, MsgTypeReactionRemove:
+		c.handleReaction(message)
+	case MsgTypeRoomMessage:
+		c.handleRoomMessage(message)
 	case MsgTypeChat, MsgTypeFile:
 		// Handle chat messages
 		c.handleChatMessage(message)
@@ -355,10 +450,53 @@ func (c *UnifiedClient) handleMessage(message UnifiedMessage) {
 		// Peer disconnected from the swarm
 		log.Printf("Peer disconnected: user %d", message.UserID)
 		c.leaveResource(message.ResourceID)
+
+	default:
+		c.sendError(ErrCodeUnknownType, "unknown message type: "+message.Type, message.Type)
 	}
 }
 
 func (c *UnifiedClient) handleChatMessage(message UnifiedMessage) {
+	if until, suspended := suspendedUntil(c.userID); suspended {
+		c.sendError(ErrCodeForbidden, suspensionMessage(until), message.Type)
+		return
+	}
+	if isBlocked(message.UserID, message.ReceiverID) {
+		c.sendError(ErrCodeForbidden, "you cannot message this user", message.Type)
+		return
+	}
+	if message.Type == MsgTypeFile && !ownsFile(c.userID, message.FileID) {
+		c.sendError(ErrCodeForbidden, "you can only send files you uploaded", message.Type)
+		return
+	}
+	// Encrypted messages carry no server-readable content
+	var e2eeHeader interface{}
+	if message.E2EE != nil {
+		if message.Type != MsgTypeChat || message.Content != "" {
+			c.sendError(ErrCodeInvalidMessage, "encrypted messages must be chat messages without content", message.Type)
+			return
+		}
+		if err := message.E2EE.validate(message.Ciphertext); err != nil {
+			c.sendError(ErrCodeInvalidMessage, err.Error(), message.Type)
+			return
+		}
+		raw, _ := json.Marshal(message.E2EE)
+		e2eeHeader = string(raw)
+	} else {
+		message.Ciphertext = ""
+	}
+
+	decision := filterContent(FilterInput{
+		Kind:     FilterKindChat,
+		SenderID: c.userID,
+		TargetID: message.ReceiverID,
+		Content:  message.Content,
+	})
+	if decision.Verdict == VerdictReject {
+		c.sendError(ErrCodeRejected, decision.Reason, message.Type)
+		return
+	}
+
 	// Check if receiver is online
 	receiverOnline := false
 	unifiedManager.mu.RLock()
@@ -367,12 +505,27 @@ func (c *UnifiedClient) handleChatMessage(message UnifiedMessage) {
 	}
 	unifiedManager.mu.RUnlock()
 
+	// Quoted replies must point into this conversation
+	if message.ReplyToID != 0 && !validReplyTarget(message.ReplyToID, message.UserID, message.ReceiverID) {
+		c.sendError(ErrCodeInvalidMessage, "reply_to_id is not part of this conversation", message.Type)
+		return
+	}
+
+	timing, err := parseMessageTiming(message.SendAt, message.ExpiresAt)
+	if err != nil {
+		c.sendError(ErrCodeInvalidMessage, err.Error(), message.Type)
+		return
+	}
+	released := timing.sendAt == nil
+	delivered := receiverOnline && released
+
 	// Persist message
 	if message.Type == MsgTypeChat {
 		var created time.Time
 		err := db.DB.QueryRow(
-			`INSERT INTO messages(sender_id, receiver_id, content, is_file, delivered) VALUES($1,$2,$3,false,$4) RETURNING created_at`,
-			message.UserID, message.ReceiverID, message.Content, receiverOnline).Scan(&created)
+			`INSERT INTO messages(sender_id, receiver_id, content, is_file, delivered, reply_to_id, send_at, expires_at, released, encrypted, ciphertext, e2ee_header) VALUES($1,$2,CASE WHEN $9 THEN NULL ELSE $3 END,false,$4,NULLIF($5,0),$6,$7,$8,$9,NULLIF($10,''),$11) RETURNING id, created_at`,
+			message.UserID, message.ReceiverID, message.Content, delivered, message.ReplyToID, timing.sendAt, timing.expiresAt, released,
+			message.E2EE != nil, message.Ciphertext, e2eeHeader).Scan(&message.MessageID, &created)
 		if err != nil {
 			log.Println("insert message:", err)
 			return
@@ -382,8 +535,8 @@ func (c *UnifiedClient) handleChatMessage(message UnifiedMessage) {
 		// file message may be created by upload endpoint; but support here too
 		var created time.Time
 		err := db.DB.QueryRow(
-			`INSERT INTO messages(sender_id, receiver_id, is_file, file_id, delivered) VALUES($1,$2,true,$3,$4) RETURNING created_at`,
-			message.UserID, message.ReceiverID, message.FileID, receiverOnline).Scan(&created)
+			`INSERT INTO messages(sender_id, receiver_id, is_file, file_id, delivered, reply_to_id, send_at, expires_at, released) VALUES($1,$2,true,$3,$4,NULLIF($5,0),$6,$7,$8) RETURNING id, created_at`,
+			message.UserID, message.ReceiverID, message.FileID, delivered, message.ReplyToID, timing.sendAt, timing.expiresAt, released).Scan(&message.MessageID, &created)
 		if err != nil {
 			log.Println("insert file message:", err)
 			return
@@ -391,6 +544,29 @@ func (c *UnifiedClient) handleChatMessage(message UnifiedMessage) {
 		message.CreatedAt = created.UTC().Format(time.RFC3339)
 	}
 
+	if timing.expiresAt != nil {
+		message.ExpiresAt = timing.expiresAt.UTC().Format(time.RFC3339)
+	}
+
+	// Scheduled messages wait for the scheduler; only the sender hears about them now
+	if !released {
+		message.SendAt = timing.sendAt.UTC().Format(time.RFC3339)
+		unifiedManager.sendToUser(c.userID, UnifiedMessage{
+			Type:       MsgTypeScheduled,
+			UserID:     c.userID,
+			ReceiverID: message.ReceiverID,
+			MessageID:  message.MessageID,
+			Status:     ScheduledQueued,
+			SendAt:     message.SendAt,
+			ExpiresAt:  message.ExpiresAt,
+			Timestamp:  time.Now(),
+		})
+		return
+	}
+
+	unarchiveOnActivity(message.UserID, message.ReceiverID)
+	message.Silent = isMuted(message.ReceiverID, message.UserID)
+
 	// Send to unified manager for routing
 	unifiedManager.broadcast <- message
 }
@@ -426,23 +602,44 @@ func (c *UnifiedClient) leaveResource(resourceID int) {
 }
 
 func (c *UnifiedClient) handlePieceRequest(message UnifiedMessage) {
-	// In a real implementation, this would serve the requested piece
-	// For now, we'll send a placeholder response
+	// Serve the piece from the server's copy, subject to the same access
+	// rules as GET /api/p2p/piece
+	hasAccess, err := hasApprovedConnection(c.userID, message.ResourceID)
+	if err != nil || !hasAccess {
+		c.sendError(ErrCodeForbidden, "approved connection required for this resource", message.Type)
+		return
+	}
+
+	piece, offset, err := readPiece(message.ResourceID, message.PieceIndex)
+	if err == errQuarantined {
+		c.sendError(ErrCodeForbidden, err.Error(), message.Type)
+		return
+	} else if err == errScanPending {
+		c.sendRetryLater(err.Error(), message.Type, scanInterval)
+		return
+	} else if err != nil {
+		c.sendError(ErrCodeNotFound, fmt.Sprintf("piece %d of resource %d unavailable", message.PieceIndex, message.ResourceID), message.Type)
+		return
+	}
+
+	sum := sha256.Sum256(piece)
 	response := UnifiedMessage{
 		Type:       PieceResponse,
 		UserID:     c.userID,
 		ResourceID: message.ResourceID,
 		PieceIndex: message.PieceIndex,
-		PieceData:  []byte("piece_data_placeholder"), // Replace with actual piece data
+		PieceData:  piece,
+		Offset:     offset,
+		PieceHash:  hex.EncodeToString(sum[:]),
 		Timestamp:  time.Now(),
 	}
-	unifiedManager.sendToUser(message.UserID, response)
+	unifiedManager.sendToUser(c.userID, response)
 }
 
 func (c *UnifiedClient) handlePieceResponse(message UnifiedMessage) {
 	// Handle received piece data
-	log.Printf("Received piece %d for resource %d from user %d",
-		message.PieceIndex, message.ResourceID, message.UserID)
+	log.Printf("Received piece %d (%d bytes) for resource %d from user %d",
+		message.PieceIndex, len(message.PieceData), message.ResourceID, message.UserID)
 }
 
 // HandleUnifiedWebSocket handles unified WebSocket connections for both chat and P2P
@@ -470,8 +667,12 @@ func HandleUnifiedWebSocket(w http.ResponseWriter, r *http.Request) {
 		conn:      conn,
 		send:      make(chan UnifiedMessage, 256),
 		resources: make(map[int]bool),
+		binary:    conn.Subprotocol() == SubprotocolV2,
 		lastPing:  time.Now(),
+
+		protocolVersion: MinProtocolVersion,
 	}
+	client.capabilities = defaultCapabilities(client.binary)
 
 	unifiedManager.register <- client
 
@@ -0,0 +1,537 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"main/db"
+	"main/storage"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resumable uploads
+//
+//	POST   /api/uploads                    create a session, returns upload_id
+//	PATCH  /api/uploads/{id}?user_id=1     append a chunk; Upload-Offset must
+//	                                       equal the bytes received so far
+//	HEAD   /api/uploads/{id}?user_id=1     Upload-Offset / Upload-Length status
+//	POST   /api/uploads/{id}/finalize      assemble and create the resource
+//	                                       or attachment
+//	DELETE /api/uploads/{id}?user_id=1     abandon the session
+//
+// Each chunk is stored as its own blob so any replica can accept the next
+// one. A chunk that fails midway is never recorded; the client asks HEAD for
+// the offset and resends from there. Sessions idle for uploadSessionTTL are
+// swept along with their chunks.
+
+// Upload session kinds
+const (
+	UploadKindResource   = "resource"
+	UploadKindAttachment = "attachment"
+)
+
+const (
+	uploadSessionTTL   = 24 * time.Hour
+	uploadSweepEvery   = 10 * time.Minute
+	maxUploadChunkSize = 64 << 20
+)
+
+// UploadSession is the client-visible state of a resumable upload
+type UploadSession struct {
+	ID           string            `json:"upload_id"`
+	UserID       int               `json:"user_id"`
+	Kind         string            `json:"kind"`
+	FileName     string            `json:"file_name"`
+	ContentType  string            `json:"content_type"`
+	Size         int64             `json:"size"`
+	Offset       int64             `json:"offset"`
+	Fields       map[string]string `json:"fields,omitempty"`
+	ExpiresAt    string            `json:"expires_at"`
+	MaxChunkSize int64             `json:"max_chunk_size"`
+}
+
+var errUploadNotFound = errors.New("upload not found or expired")
+
+func chunkPrefix(uploadID string) string {
+	return storage.PrefixUploadSessions + uploadID + "/"
+}
+
+func chunkKey(uploadID string, offset int64) string {
+	return fmt.Sprintf("%s%016d", chunkPrefix(uploadID), offset)
+}
+
+// loadUploadSession returns a live session owned by userID
+func loadUploadSession(uploadID string, userID int) (*UploadSession, error) {
+	s := &UploadSession{ID: uploadID, MaxChunkSize: maxUploadChunkSize}
+	var fields []byte
+	var expires time.Time
+	err := db.DB.QueryRow(`
+		SELECT user_id, kind, file_name, COALESCE(content_type, ''), size, received, metadata, expires_at
+		FROM upload_sessions
+		WHERE id = $1 AND expires_at > NOW() AND completed_at IS NULL
+	`, uploadID).Scan(&s.UserID, &s.Kind, &s.FileName, &s.ContentType, &s.Size, &s.Offset, &fields, &expires)
+	if err == sql.ErrNoRows || (err == nil && s.UserID != userID) {
+		return nil, errUploadNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	json.Unmarshal(fields, &s.Fields)
+	s.ExpiresAt = expires.UTC().Format(time.RFC3339)
+	return s, nil
+}
+
+// uploadPath splits /api/uploads/{id}[/action]
+func uploadPath(r *http.Request) (id, action string) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/uploads/"), "/")
+	id, action, _ = strings.Cut(rest, "/")
+	return id, action
+}
+
+func writeUploadHeaders(w http.ResponseWriter, s *UploadSession) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(s.Size, 10))
+	w.Header().Set("Upload-Expires", s.ExpiresAt)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// POST /api/uploads
+// {user_id, kind: "resource"|"attachment", file_name, size, content_type, fields: {...}}
+// Resource fields are the CreateResource form fields; attachments need
+// fields.receiver_id.
+func CreateUploadSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		UserID      int               `json:"user_id"`
+		Kind        string            `json:"kind"`
+		FileName    string            `json:"file_name"`
+		Size        int64             `json:"size"`
+		ContentType string            `json:"content_type"`
+		Fields      map[string]string `json:"fields"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxResourceFormSize)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID <= 0 || req.FileName == "" || req.Size <= 0 {
+		http.Error(w, "user_id, file_name and size required", http.StatusBadRequest)
+		return
+	}
+	if until, suspended := suspendedUntil(req.UserID); suspended {
+		http.Error(w, suspensionMessage(until), http.StatusForbidden)
+		return
+	}
+	if req.Fields == nil {
+		req.Fields = make(map[string]string)
+	}
+
+	switch req.Kind {
+	case UploadKindResource:
+		if req.Size > maxResourceSize {
+			http.Error(w, "file too large (max 500MB)", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if req.Fields["title"] == "" || req.Fields["skill_category"] == "" {
+			http.Error(w, "fields.title and fields.skill_category required", http.StatusBadRequest)
+			return
+		}
+		req.Fields["uploader_id"] = strconv.Itoa(req.UserID)
+	case UploadKindAttachment:
+		if req.Size > maxAttachmentSize {
+			http.Error(w, "file too large (max 100MB)", http.StatusRequestEntityTooLarge)
+			return
+		}
+		receiverID, err := strconv.Atoi(req.Fields["receiver_id"])
+		if err != nil || receiverID <= 0 {
+			http.Error(w, "fields.receiver_id required", http.StatusBadRequest)
+			return
+		}
+		if isBlocked(req.UserID, receiverID) {
+			http.Error(w, "you cannot message this user", http.StatusForbidden)
+			return
+		}
+	default:
+		http.Error(w, "kind must be resource or attachment", http.StatusBadRequest)
+		return
+	}
+
+	if err := checkDeclaredFileType(req.Kind, req.FileName); err != nil {
+		writeFileTypeError(w, err)
+		return
+	}
+
+	// The declared size is reserved against the quota until the upload
+	// is finalized, abandoned or expires
+	if err := checkQuota(req.UserID, req.Size); err != nil {
+		writeQuotaError(w, err)
+		return
+	}
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		http.Error(w, "cannot create upload id", http.StatusInternalServerError)
+		return
+	}
+	fields, _ := json.Marshal(req.Fields)
+
+	s := &UploadSession{
+		ID:           hex.EncodeToString(raw),
+		UserID:       req.UserID,
+		Kind:         req.Kind,
+		FileName:     storage.CleanName(req.FileName),
+		ContentType:  req.ContentType,
+		Size:         req.Size,
+		Fields:       req.Fields,
+		MaxChunkSize: maxUploadChunkSize,
+	}
+	var expires time.Time
+	err := db.DB.QueryRow(`
+		INSERT INTO upload_sessions(id, user_id, kind, file_name, content_type, size, metadata, expires_at)
+		VALUES($1, $2, $3, $4, NULLIF($5, ''), $6, $7, NOW() + make_interval(secs => $8))
+		RETURNING expires_at
+	`, s.ID, s.UserID, s.Kind, s.FileName, s.ContentType, s.Size, string(fields), uploadSessionTTL.Seconds()).Scan(&expires)
+	if err != nil {
+		http.Error(w, "Failed to create upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.ExpiresAt = expires.UTC().Format(time.RFC3339)
+
+	writeUploadHeaders(w, s)
+	w.Header().Set("Location", "/api/uploads/"+s.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+// HEAD /api/uploads/{id}?user_id=1
+func GetUploadStatus(w http.ResponseWriter, r *http.Request) {
+	id, _ := uploadPath(r)
+	userID, _ := strconv.Atoi(r.URL.Query().Get("user_id"))
+	s, err := loadUploadSession(id, userID)
+	if err == errUploadNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeUploadHeaders(w, s)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PATCH /api/uploads/{id}?user_id=1
+// Headers: Upload-Offset, Content-Length. Body: the chunk bytes.
+func UploadChunk(w http.ResponseWriter, r *http.Request) {
+	id, _ := uploadPath(r)
+	userID, _ := strconv.Atoi(r.URL.Query().Get("user_id"))
+	s, err := loadUploadSession(id, userID)
+	if err == errUploadNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Upload-Offset header required", http.StatusBadRequest)
+		return
+	}
+	if offset != s.Offset {
+		writeUploadHeaders(w, s)
+		http.Error(w, "Upload-Offset does not match the bytes received", http.StatusConflict)
+		return
+	}
+	length := r.ContentLength
+	if length <= 0 {
+		http.Error(w, "Content-Length required", http.StatusLengthRequired)
+		return
+	}
+	if length > maxUploadChunkSize || offset+length > s.Size {
+		http.Error(w, "chunk too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	key := chunkKey(s.ID, offset)
+	if err := storage.Blobs.Put(key, io.LimitReader(r.Body, length), length, "application/octet-stream"); err != nil {
+		// Nothing is recorded; the client resumes from the same offset
+		http.Error(w, "chunk not stored: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Only advance if no other request got there first
+	err = db.DB.QueryRow(`
+		UPDATE upload_sessions
+		SET received = received + $2, updated_at = NOW(), expires_at = NOW() + make_interval(secs => $4)
+		WHERE id = $1 AND received = $3 AND completed_at IS NULL
+		RETURNING received
+	`, s.ID, length, offset, uploadSessionTTL.Seconds()).Scan(&s.Offset)
+	if err == sql.ErrNoRows {
+		http.Error(w, "upload changed concurrently; check its offset", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeUploadHeaders(w, s)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// chunkReader reads a session's chunks back in order
+type chunkReader struct {
+	keys []string
+	cur  io.ReadCloser
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.cur == nil {
+			if len(c.keys) == 0 {
+				return 0, io.EOF
+			}
+			rc, err := storage.Blobs.Get(c.keys[0], 0, -1)
+			if err != nil {
+				return 0, err
+			}
+			c.cur, c.keys = rc, c.keys[1:]
+		}
+		n, err := c.cur.Read(p)
+		if err == io.EOF {
+			c.cur.Close()
+			c.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.cur != nil {
+		return c.cur.Close()
+	}
+	return nil
+}
+
+// orderedChunks lists a session's chunks and checks they tile [0, size)
+func orderedChunks(s *UploadSession) ([]string, error) {
+	blobs, err := storage.Blobs.List(chunkPrefix(s.ID))
+	if err != nil {
+		return nil, err
+	}
+	byOffset := make(map[int64]storage.ObjectInfo, len(blobs))
+	for _, b := range blobs {
+		offset, err := strconv.ParseInt(strings.TrimPrefix(b.Key, chunkPrefix(s.ID)), 10, 64)
+		if err != nil {
+			continue
+		}
+		byOffset[offset] = b
+	}
+
+	var keys []string
+	for offset := int64(0); offset < s.Size; {
+		chunk, ok := byOffset[offset]
+		if !ok || chunk.Size <= 0 {
+			return nil, fmt.Errorf("chunk at offset %d is missing", offset)
+		}
+		keys = append(keys, chunk.Key)
+		offset += chunk.Size
+	}
+	return keys, nil
+}
+
+// POST /api/uploads/{id}/finalize?user_id=1
+// Responds exactly like CreateResource or UploadFile would.
+func FinalizeUpload(w http.ResponseWriter, r *http.Request) {
+	id, action := uploadPath(r)
+	if action != "finalize" {
+		http.NotFound(w, r)
+		return
+	}
+	userID, _ := strconv.Atoi(r.URL.Query().Get("user_id"))
+	s, err := loadUploadSession(id, userID)
+	if err == errUploadNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if s.Offset != s.Size {
+		writeUploadHeaders(w, s)
+		http.Error(w, fmt.Sprintf("upload incomplete: %d of %d bytes", s.Offset, s.Size), http.StatusConflict)
+		return
+	}
+
+	// Claim the session so a retried finalize cannot create it twice
+	res, err := db.DB.Exec(`UPDATE upload_sessions SET completed_at = NOW() WHERE id = $1 AND completed_at IS NULL`, s.ID)
+	if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "upload is already being finalized", http.StatusConflict)
+		return
+	}
+
+	upload, err := assembleUpload(s)
+	if err != nil {
+		// Let the client retry; the chunks are still there
+		db.DB.Exec(`UPDATE upload_sessions SET completed_at = NULL WHERE id = $1`, s.ID)
+		http.Error(w, "cannot assemble upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer upload.discard()
+
+	// The chunks are only dropped once the upload went through, so a failed
+	// finalize can be retried without sending them again. Both handlers
+	// below commit all of their rows at once, so a failure leaves nothing
+	// a retry would duplicate.
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	defer func() {
+		if rec.status < 300 {
+			removeUploadSession(s.ID)
+		} else {
+			db.DB.Exec(`UPDATE upload_sessions SET completed_at = NULL WHERE id = $1`, s.ID)
+		}
+	}()
+	w = rec
+
+	switch s.Kind {
+	case UploadKindResource:
+		createResourceFromUpload(w, upload)
+	case UploadKindAttachment:
+		receiverID, _ := strconv.Atoi(s.Fields["receiver_id"])
+		if until, suspended := suspendedUntil(userID); suspended {
+			http.Error(w, suspensionMessage(until), http.StatusForbidden)
+			return
+		}
+		if isBlocked(userID, receiverID) {
+			http.Error(w, "you cannot message this user", http.StatusForbidden)
+			return
+		}
+		mimeType, err := checkFileType(UploadKindAttachment, s.FileName, upload.head)
+		if err != nil {
+			writeFileTypeError(w, err)
+			return
+		}
+		storedName := fmt.Sprintf("%d_%s", time.Now().UnixNano(), s.FileName)
+		if err := storage.PutFile(storage.Blobs, storage.PrefixUploads+storedName, upload.tmpPath, upload.size, mimeType); err != nil {
+			http.Error(w, "save failed:"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sendAttachment(w, userID, receiverID, s.FileName, storedName, mimeType, upload.size)
+	}
+}
+
+// statusRecorder remembers the status a handler answered with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// assembleUpload streams the chunks into a temp file, hashing as it goes,
+// and returns it in the same shape as a direct multipart upload
+func assembleUpload(s *UploadSession) (*resourceUpload, error) {
+	keys, err := orderedChunks(s)
+	if err != nil {
+		return nil, err
+	}
+	upload := &resourceUpload{fields: s.Fields, fileName: s.FileName}
+	chunks := &chunkReader{keys: keys}
+	defer chunks.Close()
+	if err := upload.spool(chunks); err != nil {
+		upload.discard()
+		return nil, err
+	}
+	if upload.size != s.Size {
+		upload.discard()
+		return nil, fmt.Errorf("assembled %d bytes, expected %d", upload.size, s.Size)
+	}
+	return upload, nil
+}
+
+// removeUploadSession deletes a session's chunks and its row
+func removeUploadSession(uploadID string) {
+	blobs, err := storage.Blobs.List(chunkPrefix(uploadID))
+	if err != nil {
+		log.Printf("Error listing chunks of upload %s: %v", uploadID, err)
+		return
+	}
+	for _, b := range blobs {
+		if err := storage.Blobs.Delete(b.Key); err != nil {
+			log.Printf("Error deleting chunk %s: %v", b.Key, err)
+			return
+		}
+	}
+	db.DB.Exec(`DELETE FROM upload_sessions WHERE id = $1`, uploadID)
+}
+
+// DELETE /api/uploads/{id}?user_id=1
+func AbortUpload(w http.ResponseWriter, r *http.Request) {
+	id, _ := uploadPath(r)
+	userID, _ := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if _, err := loadUploadSession(id, userID); err == errUploadNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "db error:"+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	removeUploadSession(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// StartUploadSweeper removes resumable uploads that were abandoned
+func StartUploadSweeper() {
+	go func() {
+		ticker := time.NewTicker(uploadSweepEvery)
+		defer ticker.Stop()
+		for range ticker.C {
+			sweepUploadSessions()
+		}
+	}()
+}
+
+func sweepUploadSessions() {
+	rows, err := db.DB.Query(`SELECT id FROM upload_sessions WHERE expires_at < NOW()`)
+	if err != nil {
+		log.Printf("Error listing expired uploads: %v", err)
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		removeUploadSession(id)
+	}
+	if len(ids) > 0 {
+		log.Printf("Removed %d abandoned uploads", len(ids))
+	}
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+)
+
+// SubprotocolV2 is the negotiated WebSocket sub-protocol that carries piece
+// data in binary frames. JSON text frames are still used for control messages.
+const SubprotocolV2 = "skillswap.v2"
+
+// Binary frame layout (all integers big-endian):
+//
+//	offset  size  field
+//	0       1     frame version (1)
+//	1       1     frame type (1 = piece data)
+//	2       4     resource ID
+//	6       4     piece index
+//	10      8     byte offset of the piece within the file
+//	18      4     payload length
+//	22      32    SHA-256 of the payload
+//	54      n     payload
+const (
+	binaryFrameVersion   = 1
+	binaryFramePiece     = 1
+	pieceFrameHeaderSize = 54
+
+	maxPieceSize         = 1024 * 1024 // 1MB pieces, matching CreateResource
+	maxJSONMessageSize   = 512 * 1024  // 512KB max control message size
+	maxBinaryMessageSize = pieceFrameHeaderSize + maxPieceSize
+)
+
+var (
+	errFrameTooShort = errors.New("binary frame too short")
+	errFrameVersion  = errors.New("unsupported binary frame version")
+	errFrameType     = errors.New("unsupported binary frame type")
+	errFrameLength   = errors.New("binary frame length mismatch")
+	errFrameHash     = errors.New("binary frame hash mismatch")
+)
+
+// encodePieceFrame packs a piece response into a binary frame
+func encodePieceFrame(message UnifiedMessage) []byte {
+	sum := sha256.Sum256(message.PieceData)
+
+	frame := make([]byte, pieceFrameHeaderSize+len(message.PieceData))
+	frame[0] = binaryFrameVersion
+	frame[1] = binaryFramePiece
+	binary.BigEndian.PutUint32(frame[2:6], uint32(message.ResourceID))
+	binary.BigEndian.PutUint32(frame[6:10], uint32(message.PieceIndex))
+	binary.BigEndian.PutUint64(frame[10:18], uint64(message.Offset))
+	binary.BigEndian.PutUint32(frame[18:22], uint32(len(message.PieceData)))
+	copy(frame[22:54], sum[:])
+	copy(frame[pieceFrameHeaderSize:], message.PieceData)
+	return frame
+}
+
+// decodePieceFrame unpacks a binary frame into a piece response, verifying
+// the declared length and payload hash
+func decodePieceFrame(frame []byte) (UnifiedMessage, error) {
+	var message UnifiedMessage
+
+	if len(frame) < pieceFrameHeaderSize {
+		return message, errFrameTooShort
+	}
+	if frame[0] != binaryFrameVersion {
+		return message, errFrameVersion
+	}
+	if frame[1] != binaryFramePiece {
+		return message, errFrameType
+	}
+
+	length := binary.BigEndian.Uint32(frame[18:22])
+	payload := frame[pieceFrameHeaderSize:]
+	if int(length) != len(payload) {
+		return message, errFrameLength
+	}
+
+	sum := sha256.Sum256(payload)
+	if string(sum[:]) != string(frame[22:54]) {
+		return message, errFrameHash
+	}
+
+	message.Type = PieceResponse
+	message.ResourceID = int(binary.BigEndian.Uint32(frame[2:6]))
+	message.PieceIndex = int(binary.BigEndian.Uint32(frame[6:10]))
+	message.Offset = int64(binary.BigEndian.Uint64(frame[10:18]))
+	message.PieceData = payload
+	message.PieceHash = hex.EncodeToString(sum[:])
+	return message, nil
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Handshake and error message types
+const (
+	MsgTypeHello   = "hello"
+	MsgTypeWelcome = "welcome"
+	MsgTypeError   = "error"
+)
+
+// Protocol versions understood by the unified socket. Version 1 is the
+// original JSON-only protocol; version 2 adds the hello/welcome handshake and
+// binary piece frames.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1
+)
+
+// Capabilities a client may request in its hello message
+const (
+	CapBinaryPieces = "binary_pieces"
+	CapTyping       = "typing"
+	CapReceipts     = "receipts"
+	CapCompression  = "compression"
+	CapE2EE         = "e2ee" // end-to-end encrypted chat, see e2ee.go
+)
+
+// Error codes carried in error frames
+const (
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeInvalidMessage     = "invalid_message"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeRejected           = "rejected"
+	ErrCodeRetryLater         = "retry_later" // see retry_after
+)
+
+// Keepalive timing for the unified socket
+const (
+	pingInterval = 54 * time.Second
+	readTimeout  = 60 * time.Second
+	writeTimeout = 10 * time.Second
+)
+
+var serverCapabilities = []string{CapBinaryPieces, CapTyping, CapReceipts, CapCompression, CapE2EE}
+
+// ServerLimits tells the client how large its frames may be and how often
+// the server pings
+type ServerLimits struct {
+	MaxMessageSize       int `json:"max_message_size"`
+	MaxBinaryMessageSize int `json:"max_binary_message_size"`
+	MaxPieceSize         int `json:"max_piece_size"`
+	PingInterval         int `json:"ping_interval"` // seconds
+	ReadTimeout          int `json:"read_timeout"`  // seconds
+}
+
+// WelcomePayload is the data of a welcome frame
+type WelcomePayload struct {
+	ProtocolVersion int          `json:"protocol_version"`
+	Capabilities    []string     `json:"capabilities"`
+	Subprotocol     string       `json:"subprotocol,omitempty"`
+	Limits          ServerLimits `json:"limits"`
+}
+
+// ErrorPayload is the data of an error frame
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	RefType string `json:"ref_type,omitempty"`
+	// RetryAfter is how many seconds to wait before retrying a retry_later
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// defaultCapabilities is what a client gets if it never sends hello, which
+// keeps pre-handshake clients working as before
+func defaultCapabilities(binary bool) map[string]bool {
+	caps := map[string]bool{
+		CapTyping:      true,
+		CapReceipts:    true,
+		CapCompression: true,
+	}
+	if binary {
+		caps[CapBinaryPieces] = true
+	}
+	return caps
+}
+
+// hasCapability reports whether the client negotiated the given capability
+func (c *UnifiedClient) hasCapability(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.capabilities[name]
+}
+
+// handleHello negotiates protocol version and capabilities and replies with
+// a welcome frame
+func (c *UnifiedClient) handleHello(message UnifiedMessage) {
+	version := message.ProtocolVersion
+	if version == 0 {
+		version = MinProtocolVersion
+	}
+	if version < MinProtocolVersion {
+		c.sendError(ErrCodeUnsupportedVersion,
+			fmt.Sprintf("protocol version %d is not supported, minimum is %d", version, MinProtocolVersion), message.Type)
+		return
+	}
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+
+	requested := make(map[string]bool, len(message.Capabilities))
+	for _, name := range message.Capabilities {
+		requested[name] = true
+	}
+
+	negotiated := make(map[string]bool)
+	var capabilities []string
+	for _, name := range serverCapabilities {
+		if !requested[name] {
+			continue
+		}
+		// Binary pieces need the skillswap.v2 sub-protocol on the upgrade
+		if name == CapBinaryPieces && (!c.binary || version < 2) {
+			continue
+		}
+		negotiated[name] = true
+		capabilities = append(capabilities, name)
+	}
+
+	c.mu.Lock()
+	c.protocolVersion = version
+	c.capabilities = negotiated
+	c.mu.Unlock()
+
+	log.Printf("User %d negotiated protocol v%d with capabilities %v", c.userID, version, capabilities)
+
+	payload := WelcomePayload{
+		ProtocolVersion: version,
+		Capabilities:    capabilities,
+		Limits: ServerLimits{
+			MaxMessageSize: maxJSONMessageSize,
+			MaxPieceSize:   maxPieceSize,
+			PingInterval:   int(pingInterval / time.Second),
+			ReadTimeout:    int(readTimeout / time.Second),
+		},
+	}
+	if c.binary {
+		payload.Subprotocol = SubprotocolV2
+		payload.Limits.MaxBinaryMessageSize = maxBinaryMessageSize
+	}
+	if payload.Capabilities == nil {
+		payload.Capabilities = []string{}
+	}
+
+	unifiedManager.sendToUser(c.userID, UnifiedMessage{
+		Type:            MsgTypeWelcome,
+		UserID:          c.userID,
+		ProtocolVersion: version,
+		Capabilities:    payload.Capabilities,
+		Data:            payload,
+		Timestamp:       time.Now(),
+	})
+}
+
+// sendError sends a structured error frame back to this client
+func (c *UnifiedClient) sendError(code, text, refType string) {
+	unifiedManager.sendToUser(c.userID, UnifiedMessage{
+		Type:   MsgTypeError,
+		UserID: c.userID,
+		Data: ErrorPayload{
+			Code:    code,
+			Message: text,
+			RefType: refType,
+		},
+		Timestamp: time.Now(),
+	})
+}
+
+// sendRetryLater tells the client the request may succeed if repeated after
+// the given delay, like a 503 with Retry-After
+func (c *UnifiedClient) sendRetryLater(text, refType string, after time.Duration) {
+	unifiedManager.sendToUser(c.userID, UnifiedMessage{
+		Type:   MsgTypeError,
+		UserID: c.userID,
+		Data: ErrorPayload{
+			Code:       ErrCodeRetryLater,
+			Message:    text,
+			RefType:    refType,
+			RetryAfter: int(after.Seconds()),
+		},
+		Timestamp: time.Now(),
+	})
+}
@@ -0,0 +1,112 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+
+	// Decoders for the formats uploads may use
+	_ "image/gif"
+)
+
+// MaxPixels bounds what Load will decode, so a small file claiming huge
+// dimensions cannot exhaust memory. A decode holds the decoded image and
+// one RGBA copy, about 5 bytes per pixel, so this is roughly 80MB; it still
+// admits ordinary phone photos, while no variant is larger than 1024px.
+const MaxPixels = 16_000_000
+
+// maxConcurrentDecodes caps how many full-size images are in memory at once
+const maxConcurrentDecodes = 2
+
+var decodeSlots = make(chan struct{}, maxConcurrentDecodes)
+
+// jpegQuality is used for every re-encoded opaque image
+const jpegQuality = 85
+
+var ErrTooLarge = errors.New("image dimensions too large")
+
+// Load decodes a JPEG, PNG or GIF (first frame), scales it down so neither
+// side exceeds maxSide and applies the JPEG's EXIF orientation, so the result
+// is upright. Metadata is not carried over. The full-size image only lives
+// inside Load, and callers wait for a free decode slot.
+func Load(data []byte, maxSide int) (*image.RGBA, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > MaxPixels {
+		return nil, ErrTooLarge
+	}
+	decodeSlots <- struct{}{}
+	img, err := decodeFit(data, maxSide)
+	<-decodeSlots
+	if err != nil {
+		return nil, err
+	}
+	// Orienting after the downscale keeps the extra copy small
+	if format == "jpeg" {
+		img = Orient(img, Orientation(data))
+	}
+	return img, nil
+}
+
+func decodeFit(data []byte, maxSide int) (*image.RGBA, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return Fit(img, maxSide), nil
+}
+
+// Fit scales img down so neither side exceeds maxSide. Smaller images are
+// only copied; nothing is scaled up.
+func Fit(img image.Image, maxSide int) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > maxSide || h > maxSide {
+		if w >= h {
+			w, h = maxSide, max(1, h*maxSide/w)
+		} else {
+			w, h = max(1, w*maxSide/h), maxSide
+		}
+	}
+	if rgba, ok := img.(*image.RGBA); ok {
+		return resize(rgba, w, h)
+	}
+	return resize(toRGBA(img), w, h)
+}
+
+// CropSquare returns the centre square of img. It shares img's pixels, so
+// it costs nothing; pass it to Fit for each size needed.
+func CropSquare(img *image.RGBA) *image.RGBA {
+	b := img.Bounds()
+	side := min(b.Dx(), b.Dy())
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	return img.SubImage(image.Rect(x0, y0, x0+side, y0+side)).(*image.RGBA)
+}
+
+// Encode writes opaque images as JPEG and anything with transparency as PNG.
+// It returns the bytes, their content type and the matching extension.
+func Encode(img *image.RGBA) (data []byte, contentType, ext string, err error) {
+	var buf bytes.Buffer
+	if img.Opaque() {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+		return buf.Bytes(), "image/jpeg", ".jpg", err
+	}
+	err = png.Encode(&buf, img)
+	return buf.Bytes(), "image/png", ".png", err
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Bounds().Min == (image.Point{}) {
+		return rgba
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+	return rgba
+}
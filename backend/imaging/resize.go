@@ -0,0 +1,71 @@
+package imaging
+
+import "image"
+
+// contrib is one source pixel's share of a destination pixel
+type contrib struct {
+	index  int
+	weight float64
+}
+
+// areaWeights maps each of dst pixels to the source pixels it covers, weighted
+// by overlap. This is a box filter over the exact footprint, which gives clean
+// downscales without ringing; dst must not exceed src.
+func areaWeights(src, dst int) [][]contrib {
+	scale := float64(src) / float64(dst)
+	out := make([][]contrib, dst)
+	for i := range out {
+		start, end := float64(i)*scale, float64(i+1)*scale
+		for j := int(start); j < src && float64(j) < end; j++ {
+			overlap := min(end, float64(j+1)) - max(start, float64(j))
+			if overlap > 0 {
+				out[i] = append(out[i], contrib{j, overlap / scale})
+			}
+		}
+	}
+	return out
+}
+
+// resize scales src to w x h by area averaging. src may be a sub-image; the
+// result has its origin at 0,0. It works one destination row at a time, so
+// memory stays proportional to the output.
+func resize(src *image.RGBA, w, h int) *image.RGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if w == sw && h == sh {
+		for y := 0; y < h; y++ {
+			copy(dst.Pix[y*dst.Stride:y*dst.Stride+w*4], src.Pix[y*src.Stride:])
+		}
+		return dst
+	}
+
+	xw := areaWeights(sw, w)
+	yw := areaWeights(sh, h)
+	row := make([]float64, w*4)
+	acc := make([]float64, w*4)
+	for dy := 0; dy < h; dy++ {
+		clear(acc)
+		for _, cy := range yw[dy] {
+			// Horizontal pass over one source row
+			clear(row)
+			line := src.Pix[cy.index*src.Stride:]
+			for dx, cols := range xw {
+				for _, cx := range cols {
+					p := line[cx.index*4 : cx.index*4+4]
+					row[dx*4] += float64(p[0]) * cx.weight
+					row[dx*4+1] += float64(p[1]) * cx.weight
+					row[dx*4+2] += float64(p[2]) * cx.weight
+					row[dx*4+3] += float64(p[3]) * cx.weight
+				}
+			}
+			for i, v := range row {
+				acc[i] += v * cy.weight
+			}
+		}
+		out := dst.Pix[dy*dst.Stride:]
+		for i, v := range acc {
+			out[i] = uint8(min(max(v+0.5, 0), 255))
+		}
+	}
+	return dst
+}
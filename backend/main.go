@@ -1,19 +1,47 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
 	"main/db"
 	"main/handlers"
+	"main/scanner"
+	"main/storage"
 	"net/http"
+	"os"
 	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
 )
 
 func main() {
+	// `backend janitor [-dry-run] [-grace 24h]` runs one cleanup pass and exits
+	if len(os.Args) > 1 && os.Args[1] == "janitor" {
+		runJanitor(os.Args[2:])
+		return
+	}
+	// `backend scan FILE...` checks files with the configured scanner
+	if len(os.Args) > 1 && os.Args[1] == "scan" {
+		runScan(os.Args[2:])
+		return
+	}
+
 	db.Connect()
+	storage.Connect()
+	scanner.Connect()
 
 	// Start WebSocket managers
 	handlers.StartUnifiedManager()
 	handlers.StartP2PManager()
+	handlers.StartPresenceService()
+	handlers.StartContentFilters()
+	handlers.StartMessageScheduler()
+	handlers.StartBlobCollector()
+	handlers.StartUploadSweeper()
+	handlers.StartJanitor()
+	handlers.StartScanWorker()
 
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./frontend/static"))))
 
@@ -22,14 +50,92 @@ func main() {
 	http.HandleFunc("/api/ws", cors(handlers.HandleUnifiedWebSocket))
 	http.HandleFunc("/api/p2p/ws", cors(handlers.HandleP2PWebSocket))
 	http.HandleFunc("/api/chats", cors(handlers.GetChatList))
+	http.HandleFunc("/api/chats/state", cors(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			handlers.UpdateConversationState(w, r)
+		} else if r.Method == "GET" {
+			handlers.GetConversationState(w, r)
+		}
+	}))
+	http.HandleFunc("/api/chats/export", cors(handlers.ExportConversation))
 	http.HandleFunc("/api/history", cors(handlers.GetHistory))
+	http.HandleFunc("/api/messages/read", cors(handlers.MarkMessagesRead))
+	http.HandleFunc("/api/messages/edit", cors(handlers.EditMessage))
+	http.HandleFunc("/api/messages/delete", cors(handlers.DeleteMessage))
+	http.HandleFunc("/api/messages/edits", cors(handlers.GetMessageEdits))
+	http.HandleFunc("/api/messages/reactions", cors(handlers.ReactToMessage))
+	http.HandleFunc("/api/messages/search", cors(handlers.SearchMessages))
+	http.HandleFunc("/api/messages/scheduled", cors(handlers.GetScheduledMessages))
+	http.HandleFunc("/api/keys", cors(handlers.PublishKeys))
+	http.HandleFunc("/api/keys/bundle", cors(handlers.GetKeyBundle))
+	http.HandleFunc("/api/keys/count", cors(handlers.GetPrekeyCount))
+	http.HandleFunc("/api/rooms", cors(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			handlers.CreateRoom(w, r)
+		} else if r.Method == "GET" {
+			handlers.GetRooms(w, r)
+		}
+	}))
+	http.HandleFunc("/api/rooms/join", cors(handlers.JoinRoom))
+	http.HandleFunc("/api/rooms/leave", cors(handlers.LeaveRoom))
+	http.HandleFunc("/api/rooms/members", cors(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			handlers.UpdateRoomMembers(w, r)
+		} else if r.Method == "GET" {
+			handlers.GetRoomMembers(w, r)
+		}
+	}))
+	http.HandleFunc("/api/rooms/history", cors(handlers.GetRoomHistory))
 	http.HandleFunc("/api/upload", cors(handlers.UploadFile))
 	http.HandleFunc("/api/file", cors(handlers.FileInfo))
+	http.HandleFunc("/api/uploads", cors(handlers.CreateUploadSession))
+	http.HandleFunc("/api/uploads/", cors(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PATCH" {
+			handlers.UploadChunk(w, r)
+		} else if r.Method == "HEAD" {
+			handlers.GetUploadStatus(w, r)
+		} else if r.Method == "POST" {
+			handlers.FinalizeUpload(w, r)
+		} else if r.Method == "DELETE" {
+			handlers.AbortUpload(w, r)
+		}
+	}))
+	http.HandleFunc("/api/storage/usage", cors(handlers.GetStorageUsage))
+	http.HandleFunc("/api/admin/quotas", cors(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			handlers.SetQuota(w, r)
+		} else if r.Method == "GET" {
+			handlers.GetQuotas(w, r)
+		}
+	}))
+	http.HandleFunc("/api/download/link", cors(handlers.GetDownloadLink))
+	http.HandleFunc("/api/download/file", cors(handlers.DownloadFile))
+	http.HandleFunc("/api/download/resource", cors(handlers.DownloadResource))
 	http.HandleFunc("/api/profile", cors(handlers.GetProfile))
 	http.HandleFunc("/api/profile/update", cors(handlers.UpdateProfile))
 	http.HandleFunc("/api/profile/photo", cors(handlers.UploadProfilePhoto))
 	http.HandleFunc("/api/users/search", cors(handlers.SearchUsers))
 	http.HandleFunc("/api/users/online", cors(handlers.GetOnlineStatus))
+	http.HandleFunc("/api/users/block", cors(handlers.BlockUser))
+	http.HandleFunc("/api/reports", cors(handlers.CreateReport))
+	http.HandleFunc("/api/moderation/reports", cors(handlers.GetModerationQueue))
+	http.HandleFunc("/api/moderation/action", cors(handlers.ModerateReport))
+	http.HandleFunc("/api/moderation/filter-rules", cors(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			handlers.UpdateFilterRules(w, r)
+		} else if r.Method == "GET" {
+			handlers.GetFilterRules(w, r)
+		}
+	}))
+	http.HandleFunc("/api/moderation/quarantine", cors(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			handlers.UpdateQuarantine(w, r)
+		} else if r.Method == "GET" {
+			handlers.GetQuarantine(w, r)
+		}
+	}))
+	http.HandleFunc("/api/moderation/filter-decisions", cors(handlers.GetFilterDecisions))
+	http.HandleFunc("/api/users/blocks", cors(handlers.GetBlockedUsers))
 	http.HandleFunc("/api/dashboard/stats", cors(handlers.GetDashboardStats))
 
 	// Skills endpoints
@@ -44,6 +150,8 @@ func main() {
 	http.HandleFunc("/api/p2p/resource/", cors(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" {
 			handlers.GetResourceDetails(w, r)
+		} else if r.Method == "DELETE" {
+			handlers.DeleteResource(w, r)
 		}
 	}))
 	http.HandleFunc("/api/p2p/swarm/", cors(func(w http.ResponseWriter, r *http.Request) {
@@ -137,14 +245,71 @@ func main() {
 		http.NotFound(w, r)
 	})
 
-	// Serve files
-	http.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir("./uploads"))))
-	http.Handle("/p2p_resources/", http.StripPrefix("/p2p_resources/", http.FileServer(http.Dir("./p2p_resources"))))
+	// Profile photos are public; attachments and resources go through /api/download
+	http.HandleFunc("/uploads/profiles/", handlers.ServeProfilePhoto)
 
 	log.Println("Backend running on http://localhost:8080")
 	http.ListenAndServe(":8080", nil)
 }
 
+// runJanitor reports orphaned storage and, without -dry-run, removes it
+func runJanitor(args []string) {
+	fs := flag.NewFlagSet("janitor", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report orphans without deleting anything")
+	grace := fs.Duration("grace", 24*time.Hour, "leave anything modified more recently than this")
+	fs.Parse(args)
+
+	db.Connect()
+	storage.Connect()
+
+	report := handlers.RunJanitor(*grace, *dryRun)
+	for _, o := range report.Orphans {
+		fmt.Printf("%s\t%d\t%s\t%s\n", o.Key, o.Size, o.LastModified.UTC().Format(time.RFC3339), o.Reason)
+	}
+	for _, e := range report.Errors {
+		fmt.Fprintln(os.Stderr, "error:", e)
+	}
+	if *dryRun {
+		fmt.Printf("%d orphans, %d bytes (dry run, nothing deleted)\n", len(report.Orphans), report.OrphanBytes())
+	} else {
+		fmt.Printf("removed %d of %d orphans, %d bytes\n", report.Removed, len(report.Orphans), report.RemovedBytes)
+	}
+	if len(report.Errors) > 0 {
+		os.Exit(1)
+	}
+}
+
+// runScan scans local files without touching the database, e.g. to check
+// that clamd is reachable and detects the EICAR test file
+func runScan(args []string) {
+	godotenv.Load()
+	scanner.Connect()
+
+	infected := false
+	for _, path := range args {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(2)
+		}
+		result, err := scanner.Default.Scan(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: error: %v\n", path, err)
+			os.Exit(2)
+		}
+		if result.Infected {
+			infected = true
+			fmt.Printf("%s: %s FOUND\n", path, result.Signature)
+		} else {
+			fmt.Printf("%s: OK\n", path)
+		}
+	}
+	if infected {
+		os.Exit(1)
+	}
+}
+
 func cors(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		origin := r.Header.Get("Origin")
@@ -170,8 +335,9 @@ func cors(next http.HandlerFunc) http.HandlerFunc {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 		}
 
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, HEAD, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Upload-Offset")
+		w.Header().Set("Access-Control-Expose-Headers", "Location, Upload-Offset, Upload-Length, Upload-Expires")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 		if r.Method == "OPTIONS" { // Preflight
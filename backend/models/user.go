@@ -16,6 +16,9 @@ type User struct {
 	Availability string `json:"availability,omitempty"`
 	LinkedIn     string `json:"linkedin,omitempty"`
 	Github       string `json:"github,omitempty"`
+
+	// Avatar sizes of an uploaded profile photo, by variant name
+	ProfilePhotoVariants map[string]string `json:"profile_photo_variants,omitempty"`
 }
 
 type UserDB struct {
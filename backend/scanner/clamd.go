@@ -0,0 +1,140 @@
+package scanner
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is how much is sent per INSTREAM chunk; clamd's
+// StreamMaxLength still bounds the total
+const clamdChunkSize = 64 << 10
+
+// Clamd scans through a ClamAV daemon using its INSTREAM command
+type Clamd struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// NewClamd parses tcp://host:port, unix:///path or a bare host:port. timeout
+// bounds every read and write, not the whole scan.
+func NewClamd(addr string, timeout time.Duration) (*Clamd, error) {
+	c := &Clamd{network: "tcp", address: addr, timeout: timeout}
+	switch {
+	case strings.HasPrefix(addr, "tcp://"):
+		c.address = strings.TrimPrefix(addr, "tcp://")
+	case strings.HasPrefix(addr, "unix://"):
+		c.network, c.address = "unix", strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "/"):
+		c.network = "unix"
+	}
+	if c.address == "" {
+		return nil, errors.New("clamd address is empty")
+	}
+	return c, nil
+}
+
+func (c *Clamd) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout(c.network, c.address, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	return conn, nil
+}
+
+// Ping checks the daemon is up
+func (c *Clamd) Ping() error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+		return err
+	}
+	reply, err := readReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("clamd: unexpected reply %q", reply)
+	}
+	return nil
+}
+
+func (c *Clamd) Scan(r io.Reader) (Result, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+
+	if err := c.stream(conn, r); err != nil {
+		// clamd hangs up early when the stream is over its size limit;
+		// its reply says why
+		if reply, readErr := readReply(conn); readErr == nil && strings.HasSuffix(reply, "ERROR") {
+			return Result{}, fmt.Errorf("clamd: %s", reply)
+		}
+		return Result{}, err
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		return Result{}, err
+	}
+	return parseReply(reply)
+}
+
+// stream sends r as length-prefixed chunks followed by a zero-length chunk
+func (c *Clamd) stream(conn net.Conn, r io.Reader) error {
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			conn.SetDeadline(time.Now().Add(c.timeout))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	_, err := conn.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// readReply reads one NUL-terminated reply
+func readReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(err == io.EOF && reply != "") {
+		return "", err
+	}
+	return strings.TrimSpace(strings.TrimSuffix(reply, "\x00")), nil
+}
+
+// parseReply reads "stream: OK", "stream: <signature> FOUND" or "... ERROR"
+func parseReply(reply string) (Result, error) {
+	status := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case status == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(status, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(status, " FOUND")}, nil
+	}
+	return Result{}, fmt.Errorf("clamd: %s", reply)
+}
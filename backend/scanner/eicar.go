@@ -0,0 +1,37 @@
+package scanner
+
+import (
+	"bytes"
+	"io"
+)
+
+// EICARTestString is the industry-standard antivirus test file. It is
+// harmless, and every real scanner detects it.
+const EICARTestString = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// EICAR flags content containing the EICAR test string and nothing else,
+// so quarantine can be exercised without a real scanner
+type EICAR struct{}
+
+func (EICAR) Scan(r io.Reader) (Result, error) {
+	needle := []byte(EICARTestString)
+	buf := make([]byte, 32<<10)
+	// Keep the tail of the previous read so a match split across reads is found
+	var window []byte
+	for {
+		n, err := r.Read(buf)
+		window = append(window, buf[:n]...)
+		if bytes.Contains(window, needle) {
+			io.Copy(io.Discard, r)
+			return Result{Infected: true, Signature: "Eicar-Test-Signature"}, nil
+		}
+		if keep := len(needle) - 1; len(window) > keep {
+			window = append(window[:0], window[len(window)-keep:]...)
+		}
+		if err == io.EOF {
+			return Result{}, nil
+		} else if err != nil {
+			return Result{}, err
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when a key does not exist
+var ErrNotFound = errors.New("blob not found")
+
+// ObjectInfo describes a stored blob
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+// BlobStore is where uploaded bytes live. Keys are slash-separated paths
+// such as "uploads/123_notes.pdf".
+type BlobStore interface {
+	// Put stores size bytes read from r under key, replacing any existing blob
+	Put(key string, r io.Reader, size int64, contentType string) error
+	// Get returns length bytes starting at offset; a negative length reads
+	// to the end of the blob
+	Get(key string, offset, length int64) (io.ReadCloser, error)
+	Stat(key string) (ObjectInfo, error)
+	// Delete removes key; deleting a missing key is not an error
+	Delete(key string) error
+	// List returns every blob whose key starts with prefix
+	List(prefix string) ([]ObjectInfo, error)
+}
+
+// FilePutter is implemented by stores that can take ownership of a local
+// file without copying it
+type FilePutter interface {
+	PutFile(key, path string) error
+}
+
+// PartialLister is implemented by stores that can leave interrupted writes
+// behind, such as the temp files of a crashed local Put. The returned keys
+// can be passed to Delete.
+type PartialLister interface {
+	ListPartial(prefix string) ([]ObjectInfo, error)
+}
+
+// PutFile moves the file at path into store under key. Stores that can
+// rename do so atomically; others get a streamed copy. The file at path is
+// gone afterwards either way.
+func PutFile(store BlobStore, key, path string, size int64, contentType string) error {
+	if fp, ok := store.(FilePutter); ok {
+		return fp.PutFile(key, path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	defer f.Close()
+	return store.Put(key, f, size, contentType)
+}
+
+// Key prefixes for each kind of upload
+const (
+	PrefixUploads   = "uploads/"
+	PrefixProfiles  = "uploads/profiles/"
+	PrefixResources = "p2p_resources/"
+	PrefixPreviews  = "previews/"
+
+	// Chunks of resumable uploads, one blob per chunk
+	PrefixUploadSessions = "upload_sessions/"
+)
+
+// Blobs is the configured store, set by Connect
+var Blobs BlobStore
+
+// Connect configures Blobs from the environment:
+//
+//	STORAGE_DRIVER      local (default) or s3
+//	STORAGE_LOCAL_ROOT  directory for the local driver, default "."
+//	S3_ENDPOINT         e.g. http://minio:9000 or https://s3.eu-west-1.amazonaws.com
+//	S3_REGION           default us-east-1
+//	S3_BUCKET, S3_ACCESS_KEY, S3_SECRET_KEY
+//
+// The local root defaults to the working directory so files written before
+// the store existed keep their paths.
+func Connect() {
+	switch driver := getEnv("STORAGE_DRIVER", "local"); driver {
+	case "local":
+		root := getEnv("STORAGE_LOCAL_ROOT", ".")
+		Blobs = NewLocalStore(root)
+		log.Printf("Using local blob storage at %s", root)
+	case "s3":
+		store, err := NewS3Store(S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    getEnv("S3_REGION", "us-east-1"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		})
+		if err != nil {
+			log.Fatal("S3 storage misconfigured: ", err)
+		}
+		Blobs = store
+		log.Printf("Using S3 blob storage at %s/%s", store.endpoint, store.bucket)
+	default:
+		log.Fatalf("unknown STORAGE_DRIVER %q", driver)
+	}
+}
+
+// CleanName strips any directory part from a user-supplied file name so it
+// cannot escape its prefix
+func CleanName(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	if name == "" || name == "." || name == ".." {
+		return "file"
+	}
+	return name
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// Reader is an io.ReadSeeker over a blob that fetches bytes lazily from the
+// current offset, so http.ServeContent can answer range requests without
+// downloading the whole blob
+type Reader struct {
+	store BlobStore
+	key   string
+	size  int64
+	pos   int64
+	rc    io.ReadCloser
+}
+
+// Open stats key and returns a Reader positioned at the start
+func Open(store BlobStore, key string) (*Reader, ObjectInfo, error) {
+	info, err := store.Stat(key)
+	if err != nil {
+		return nil, info, err
+	}
+	return &Reader{store: store, key: key, size: info.Size}, info, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.rc == nil {
+		rc, err := r.store.Get(r.key, r.pos, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.rc = rc
+	}
+	n, err := r.rc.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekCurrent:
+		pos += r.pos
+	case io.SeekEnd:
+		pos += r.size
+	}
+	if pos < 0 {
+		return r.pos, errors.New("storage: negative position")
+	}
+	if pos != r.pos && r.rc != nil {
+		r.rc.Close()
+		r.rc = nil
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+func (r *Reader) Close() error {
+	if r.rc != nil {
+		return r.rc.Close()
+	}
+	return nil
+}
@@ -333,7 +333,7 @@ function appendMessage(m) {
     if (m.is_file) {
         // Handle file messages
         if (m.file_id) {
-            fetch(`${API_CONFIG.BASE_URL}${API_CONFIG.ENDPOINTS.FILE}?id=${m.file_id}`)
+            fetch(`${API_CONFIG.BASE_URL}${API_CONFIG.ENDPOINTS.FILE}?id=${m.file_id}&user_id=${me}`)
                 .then(response => response.json())
                 .then(info => {
                     d.innerHTML = `